@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 
 	"github.com/aarondl/dbm/config"
 	"github.com/aarondl/paths"
@@ -25,7 +26,11 @@ Commands:
     init                    - Create a basic configuration file.
     new      [name]...      - Create a new named migration.
     migrate  [step]         - Migrate [step] forward, migrate all if no step number given.
+    migrate  -to version    - Migrate forward up to and including version.
     rollback [step]         - Rollback [step] backward, rollback all if no step number given.
+    rollback -to version    - Rollback every migration newer than version.
+    status                  - Show which migrations have been run.
+    sql      [-down] [step] - Write the migrations that would run to a script (-o file).
     create                  - Create the configured database.
     drop                    - Drop the configured database.
     trackdb                 - Create only the migration table.`
@@ -36,21 +41,47 @@ var (
 		`If true use cwd as root, otherwise find VCS root.`)
 	environ = flagset.String("env", "development",
 		`Set the enviroment to choose from the config file.`)
-	verbose = flagset.Bool("v", false, "Controls verbose output.")
+	verbose    = flagset.Bool("v", false, "Controls verbose output.")
+	allowDrift = flagset.Bool("allowdrift", false,
+		`If true warn instead of failing when a run migration was modified.`)
+	atomic = flagset.Bool("atomic", false,
+		`If true run all migrations in one transaction (postgres, sqlite3).`)
+	dryRun = flagset.Bool("dry-run", false,
+		`If true print the statements migrate and rollback would run instead.`)
+	outOfOrder = flagset.Bool("outoforder", false,
+		`If true run any migration that hasn't been run, even older ones.`)
+	lockTimeout = flagset.Duration("lock-timeout", time.Minute,
+		`How long to wait for another dbm migrating the same database.`)
+	format = flagset.String("format", formatText,
+		`Output format, text or json.`)
+	moduleName = flagset.String("module", "",
+		`Only work on this module, otherwise all of them.`)
+	dbURL = flagset.String("url", "",
+		`Connect to this database url instead of using the config file.`)
 )
 
+func init() {
+	flagset.StringVar(dbURL, "dsn", "", `Same as -url.`)
+}
+
 var (
 	rgxEnviron = regexp.MustCompile(`^[a-z]+$`)
 )
 
 var (
 	workingDir string
+	// command is the command being run.
+	command string
+	// started is when the command started.
+	started = time.Now()
 )
 
 var commands = map[string]func([]string){
 	"new":      newMigration,
 	"migrate":  doMigrations,
 	"rollback": doRollback,
+	"status":   showStatus,
+	"sql":      writeScript,
 	"create":   createDatabase,
 	"drop":     dropDatabase,
 	"trackdb":  trackdb,
@@ -78,6 +109,11 @@ func main() {
 		printUsage()
 	}
 	cmdArgs = cmdArgs[1:]
+	command = cmd
+
+	if *format != formatText && *format != formatJSON {
+		printUsage()
+	}
 
 	// Verify environment
 	if !rgxEnviron.MatchString(*environ) {
@@ -85,9 +121,35 @@ func main() {
 			" must be lowercase letters only.")
 	}
 
+	// A database url replaces the config file. DATABASE_URL only does when
+	// there's no config file, so that it can't quietly replace -env.
+	configFile, err := config.Find()
+	if err != nil {
+		exitLn("Could not find config:", err)
+	}
+	source := "-url"
+	envURL := os.Getenv(config.ENV_URL)
+	switch {
+	case len(*dbURL) != 0:
+	case len(configFile) != 0:
+		source = fmt.Sprintf("%s [%s]", configFile, *environ)
+		if len(envURL) != 0 {
+			source += ", ignoring " + config.ENV_URL
+		}
+	case len(envURL) != 0:
+		if flagPassed("env") {
+			exitf("Error: No config file for -env %s, %s has no environments\n",
+				*environ, config.ENV_URL)
+		}
+		*dbURL = envURL
+		source = config.ENV_URL
+	}
+
 	// Set the working directory.
 	setRoot()
-	fmt.Println(workingDir)
+	if !jsonOutput() {
+		fmt.Println(workingDir)
+	}
 
 	// We have to initialize here since we can't load the config if someone
 	// wants to create it!
@@ -97,14 +159,34 @@ func main() {
 	}
 
 	// Parse the config
-	if err := config.Load(*environ); err != nil {
+	if len(*dbURL) != 0 {
+		if err := config.LoadURL(*dbURL); err != nil {
+			exitLn("Could not load config:", err)
+		}
+	} else if err := config.Load(*environ); err != nil {
 		exitLn("Could not load config:", err)
 	}
 
+	if !jsonOutput() {
+		fmt.Println("Using", source)
+	}
+
 	// Dispatch the command handler.
 	commands[cmd](cmdArgs)
 }
 
+// flagPassed is true if the flag was given on the command line rather than
+// left at its default.
+func flagPassed(name string) bool {
+	passed := false
+	flagset.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
 func printUsage() {
 	fmt.Println(usageDesc)
 	fmt.Println("Flags:")
@@ -115,16 +197,25 @@ func printUsage() {
 }
 
 func exit(args ...interface{}) {
+	if jsonOutput() {
+		exitJSON(fmt.Sprint(args...))
+	}
 	fmt.Print(args...)
 	os.Exit(1)
 }
 
 func exitf(format string, args ...interface{}) {
+	if jsonOutput() {
+		exitJSON(fmt.Sprintf(format, args...))
+	}
 	fmt.Printf(format, args...)
 	os.Exit(1)
 }
 
 func exitLn(args ...interface{}) {
+	if jsonOutput() {
+		exitJSON(fmt.Sprintln(args...))
+	}
 	fmt.Println(args...)
 	os.Exit(1)
 }
@@ -143,7 +234,14 @@ func setRoot() {
 
 	var p string
 	if _, p, err = paths.FindVCSRoot(wd); err != nil || len(p) == 0 {
-		exitLn("Error: Could not find vcs root.")
+		// Without a config file to find there may be no checkout at all, in
+		// which case everything is relative to the cwd.
+		if len(*dbURL) == 0 {
+			exitLn("Error: Could not find vcs root.")
+		}
+		*isRoot = true
+		workingDir = wd
+		return
 	}
 	workingDir = p
 }
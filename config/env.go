@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ENV_PREFIX begins the name of the environment variables that override
+// config values, they're named DBM_<ENVIRONMENT>_<FIELD> eg. DBM_PRODUCTION_PASS
+// or DBM_PRODUCTION_PASS_FILE.
+const ENV_PREFIX = "DBM_"
+
+const errOverride = "dbmconfig: Invalid override - "
+
+// rgxInterpolate matches ${VAR} and ${VAR:-default}.
+var rgxInterpolate = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// interpolate replaces ${VAR} in every string field of every environment
+// with the value of VAR, or with the default in ${VAR:-default} when VAR is
+// unset or empty. Overrides are applied afterwards and are taken literally.
+func (c Configuration) interpolate() error {
+	for env, d := range c {
+		v := reflect.ValueOf(d).Elem()
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+
+			field := v.Field(i)
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString(expand(field.String()))
+			case reflect.Slice:
+				// Modules
+				for j := 0; j < field.Len(); j++ {
+					expandStruct(field.Index(j))
+				}
+			}
+
+			key := t.Field(i).Tag.Get("toml")
+			if len(key) == 0 {
+				key = t.Field(i).Name
+			}
+			name := ENV_PREFIX + strings.ToUpper(env) + "_" + strings.ToUpper(key)
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setField(field, val); err != nil {
+				return errors.New(errOverride + name + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// expandStruct replaces the variable references in the string fields of v.
+func expandStruct(v reflect.Value) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Field(i); field.Kind() == reflect.String && field.CanSet() {
+			field.SetString(expand(field.String()))
+		}
+	}
+}
+
+// expand replaces the variable references in s.
+func expand(s string) string {
+	return rgxInterpolate.ReplaceAllStringFunc(s, func(ref string) string {
+		match := rgxInterpolate.FindStringSubmatch(ref)
+		if val := os.Getenv(match[1]); len(val) != 0 {
+			return val
+		}
+		return match[2]
+	})
+}
+
+func setField(field reflect.Value, val string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	default:
+		return errors.New("unsupported field type " + field.Kind().String())
+	}
+
+	return nil
+}
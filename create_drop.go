@@ -2,28 +2,42 @@ package main
 
 import (
 	"github.com/aarondl/dbm/config"
+	"github.com/aarondl/dbm/migrator"
 )
 
 func createDatabase(args []string) {
-	engine, err := NewEngine(config.Current)
+	engine, err := migrator.NewEngine(config.Current, !*isRoot)
 	if err != nil {
 		exitLn("Error getting handle to db:", err)
 	}
 	if err = engine.CreateDB(); err != nil {
 		exitLn("Error creating db:", err)
 	}
-	trackdbHelper(args, engine)
+	createTrackTables()
+	if jsonOutput() {
+		writeSummary(nil)
+	}
 }
 
 func trackdb(args []string) {
-	engine, err := NewEngine(config.Current)
-	if err != nil {
-		exitLn("Error getting handle to db:", err)
+	createTrackTables()
+	if jsonOutput() {
+		writeSummary(nil)
 	}
-	trackdbHelper(args, engine)
 }
 
-func trackdbHelper(args []string, engine SqlEngine) {
+// createTrackTables creates the tracking table of each module.
+func createTrackTables() {
+	for _, mod := range getModules() {
+		engine, err := migrator.NewEngine(mod.conf, !*isRoot)
+		if err != nil {
+			exitLn("Error getting handle to db:", err)
+		}
+		trackdbHelper(engine)
+	}
+}
+
+func trackdbHelper(engine migrator.SqlEngine) {
 	if err := engine.Open(); err != nil {
 		exitLn("Error opening to db:", err)
 	}
@@ -34,11 +48,14 @@ func trackdbHelper(args []string, engine SqlEngine) {
 }
 
 func dropDatabase(args []string) {
-	engine, err := NewEngine(config.Current)
+	engine, err := migrator.NewEngine(config.Current, !*isRoot)
 	if err != nil {
 		exitLn("Error getting handle to db:", err)
 	}
 	if err = engine.DropDB(); err != nil {
 		exitLn("Error dropping db:", err)
 	}
+	if jsonOutput() {
+		writeSummary(nil)
+	}
 }
@@ -10,4 +10,7 @@ func initialize(args []string) {
 	if err := config.Touch(configDir); err != nil {
 		exitLn("Error creating config:", err)
 	}
+	if jsonOutput() {
+		writeSummary(nil)
+	}
 }
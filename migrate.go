@@ -1,247 +1,178 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"database/sql"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
-	"sort"
 	"strconv"
-	"strings"
 
 	"github.com/aarondl/dbm/config"
+	"github.com/aarondl/dbm/migrator"
 )
 
-const errFmtNoMatch = `Error: Migrations are out of sync
-Possible problems:
-   Migration file starting with "%s" missing OR
-   Migration file created after migrations run: %s
-`
-const errOutOfSync = `Error: Migrations are out of sync
-The following migration files are missing:`
-
-var rgxUpDown = regexp.MustCompile(`(?s)(.*?)(?:\s` + _MIG_SEPERATOR + `\s(.*))?`)
-
-// sqlExecer exists only for test stubbing.
-type sqlExecer interface {
-	Exec(string, ...interface{}) (sql.Result, error)
-}
-
 func doMigrations(args []string) {
-	engine, files, done, err := getMigrationData()
-	defer engine.Close()
-	if err != nil {
-		exitLn("Error getting migration data:", err)
+	mods := getModules()
+	step, to := getTarget(flag.NewFlagSet("migrate", flag.ExitOnError), args)
+	if len(mods) > 1 && (step != 0 || len(to) != 0) {
+		exitLn("Error: -module is required with a number of steps or -to")
 	}
 
-	diff := len(files) - len(done)
-	if diff == 0 {
-		exitLn("Up to date.")
-	}
+	total := 0
+	for _, mod := range mods {
+		mod.header()
+		m := openMigrator(mod, true)
 
-	step := getStep(args)
-	if step == 0 || step > diff {
-		step = diff
+		var n int
+		var err error
+		if len(to) != 0 {
+			n, err = m.UpTo(to)
+		} else {
+			n, err = m.Up(step)
+		}
+		m.Close()
+		if err != nil {
+			exitLn("Error:", err)
+		}
+		total += n
 	}
-
-	ensureRunMigrationsMatch(files, done)
-
-	toMigrate := files[len(done) : len(done)+step]
-	fmt.Println("Running", step, "migrations...")
-
-	for i := 0; i < len(toMigrate); i++ {
-		migrate(engine, toMigrate[i], false)
+	if jsonOutput() {
+		writeSummary(map[string]int{"migrations": total})
+	} else if total == 0 {
+		exitLn("Up to date.")
 	}
 }
 
 func doRollback(args []string) {
-	engine, files, done, err := getMigrationData()
-	defer engine.Close()
-	if err != nil {
-		exitLn("Error getting migration data:", err)
-	}
+	m := openMigrator(getModule("rollback"), true)
+	defer m.Close()
 
-	if len(done) == 0 {
-		exitLn("Nothing to rollback.")
-	}
+	step, to := getTarget(flag.NewFlagSet("rollback", flag.ExitOnError), args)
 
-	step := getStep(args)
-	if step == 0 {
-		step = 1
+	var n int
+	var err error
+	if len(to) != 0 {
+		n, err = m.DownTo(to)
+	} else {
+		n, err = m.Down(step)
 	}
-	if step > len(done) {
-		step = len(done)
+	if err != nil {
+		exitLn("Error:", err)
 	}
-
-	ensureRunMigrationsMatch(files, done)
-
-	toRollback := files[len(done)-step : len(done)]
-	fmt.Println("Rolling back", step, "migrations...")
-
-	for i := len(toRollback) - 1; i >= 0; i-- {
-		migrate(engine, toRollback[i], true)
+	if jsonOutput() {
+		writeSummary(map[string]int{"migrations": n})
+	} else if n == 0 {
+		exitLn("Nothing to rollback.")
 	}
 }
 
-func migrate(engine SqlEngine, migration string, rollback bool) {
-	var err error
-
-	shortname := filepath.Base(migration)
-	up, down := getMigrationParts(migration, shortname)
-	if *verbose {
-		fmt.Println("=====================================")
-		fmt.Println(shortname)
-		fmt.Println("=====================================")
-	} else {
-		fmt.Println(shortname)
-	}
+// module is a set of migrations the command should work on.
+type module struct {
+	// name is empty when no modules are configured.
+	name string
+	conf *config.DB
+}
 
-	if rollback && len(down) == 0 {
-		exitLn("Tried to rollback migration without down:", shortname)
+// header prints the name of the module before its output.
+func (mod module) header() {
+	if len(mod.name) != 0 && !jsonOutput() {
+		fmt.Printf("Module %s:\n", mod.name)
 	}
+}
 
-	tx, err := engine.Begin()
-	if err != nil {
-		fmt.Print("Beginning transaction\t")
-		fmt.Println("[FAIL]")
-		exitLn("Failed to begin transaction:", err)
-	} else if *verbose {
-		fmt.Print("Beginning transaction\t")
-		fmt.Println("[SUCCESS]")
+// getModules returns the module chosen by -module, or every configured
+// module in the order they're listed. If none are configured the whole
+// database is one unnamed module.
+func getModules() []module {
+	if len(*moduleName) != 0 {
+		conf, err := config.Current.Module(*moduleName)
+		if err != nil {
+			exitLn("Error:", err)
+		}
+		return []module{{*moduleName, conf}}
 	}
 
-	part := up
-	writeMigration := engine.AddMigration
-	if rollback {
-		part = down
-		writeMigration = engine.DeleteMigration
+	if len(config.Current.Modules) == 0 {
+		return []module{{"", config.Current}}
 	}
 
-	var txErr error
-
-	txErr = runMigrationPart(tx, part)
-	if txErr == nil {
-		txErr = writeMigration(tx, migFormat(migration))
+	mods := make([]module, len(config.Current.Modules))
+	for i, m := range config.Current.Modules {
+		conf, err := config.Current.Module(m.Name)
+		if err != nil {
+			exitLn("Error:", err)
+		}
+		mods[i] = module{m.Name, conf}
 	}
+	return mods
+}
 
-	if txErr != nil {
-		fmt.Print("Rollback transaction\t")
-		if err = tx.Rollback(); err != nil {
-			fmt.Println("[FAIL]")
-			fmt.Println("Failed to roll back:", err)
-			exitLn(txErr)
-		} else {
-			fmt.Println("[SUCCESS]")
-			exitLn(txErr)
-		}
-	} else {
-		if err = tx.Commit(); err != nil {
-			fmt.Print("Commit transaction\t")
-			fmt.Println("[FAIL]")
-			exitLn("Failed to commit:", err)
-		} else if *verbose {
-			fmt.Print("Commit transaction\t")
-			fmt.Println("[SUCCESS]")
-		}
+// getModule returns the single module a command works on, commands that
+// can't work on several at once need -module when there are some.
+func getModule(cmd string) module {
+	mods := getModules()
+	if len(mods) > 1 {
+		exitf("Error: -module is required to %s\n", cmd)
 	}
+	return mods[0]
 }
 
-func getMigrationParts(filename, shortname string) ([]byte, []byte) {
-	f, err := os.Open(filename)
+// openMigrator creates a migrator for the module set up from the command line
+// flags. If connect is false the database is not opened.
+func openMigrator(mod module, connect bool) *migrator.Migrator {
+	engine, err := migrator.NewEngine(mod.conf, !*isRoot)
 	if err != nil {
-		exitLn("Could not open file:", shortname, "-", err)
+		exitLn("Error getting handle to db:", err)
 	}
-	defer f.Close()
 
-	var up, down bytes.Buffer
-	var sep = []byte(_MIG_SEPERATOR)
-	var doingDown = false
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			exitLn("Failed to read file:", shortname, "-", err)
+	if connect {
+		if err = engine.Open(); err != nil {
+			exitLn("Failed to connect to database.", err)
 		}
+	}
 
-		if bytes.Equal(sep, scanner.Bytes()) {
-			doingDown = true
-			continue
-		}
+	m := migrator.New(engine, os.DirFS(migrationsDir(mod.conf)))
+	m.Log = os.Stdout
+	if jsonOutput() {
+		m.Log = os.Stderr
+		m.Events = func(e migrator.Event) { writeMigration(mod.name, e) }
+	}
+	m.Verbose = *verbose
+	m.AllowDrift = *allowDrift
+	m.OutOfOrder = *outOfOrder
+	m.DryRun = *dryRun
+	m.Atomic = *atomic
+	m.LockTimeout = *lockTimeout
+	// Go migrations are run by the programs that register them, dbm can only
+	// see that they were.
+	m.AllowUnregistered = true
+	return m
+}
 
-		if doingDown {
-			down.Write(scanner.Bytes())
-			down.WriteByte('\n')
-		} else {
-			up.Write(scanner.Bytes())
-			up.WriteByte('\n')
-		}
+// migrationsDir is the migrations directory configured in conf, relative to
+// the working directory unless it's absolute.
+func migrationsDir(conf *config.DB) string {
+	dir := conf.MigrationsDir
+	if len(dir) == 0 {
+		return filepath.Join(workingDir, _DATA_DIR, _MIG_DIR)
 	}
-
-	return up.Bytes(), down.Bytes()
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(workingDir, dir)
 }
 
-func runMigrationPart(exec sqlExecer, part []byte) error {
-	var quote, dblQuote, backQuote bool
+// getTarget parses the arguments to migrate and rollback, which are either a
+// number of steps or -to and the version to stop at. Commands with more flags
+// can define them on fs before calling.
+func getTarget(fs *flag.FlagSet, args []string) (int, string) {
+	to := fs.String("to", "", "The version to "+fs.Name()+" to.")
+	fs.Parse(args)
 
-	lastIndex := 0
-	for i := 0; i < len(part); i++ {
-		switch part[i] {
-		case '\'':
-			if dblQuote || backQuote {
-				break
-			}
-			quote = !quote
-		case '"':
-			if quote || backQuote {
-				break
-			}
-			dblQuote = !dblQuote
-		case '`':
-			if quote || dblQuote {
-				break
-			}
-			backQuote = !backQuote
-		case '-':
-			if i+1 >= len(part) || part[i+1] != '-' {
-				break
-			}
-			fallthrough
-		case '#':
-			if quote || dblQuote || backQuote {
-				break
-			}
-			for part[i] != '\n' {
-				i++
-			}
-		case '/':
-			if quote || dblQuote || backQuote {
-				break
-			}
-			if i+1 < len(part) && part[i+1] == '*' {
-				i += 2
-				for i < len(part) && !(part[i-1] == '*' && part[i] == '/') {
-					i++
-				}
-			}
-		case ';':
-			if quote || dblQuote || backQuote {
-				break
-			}
-			cmd := string(part[lastIndex : i+1])
-			if _, err := exec.Exec(cmd); err != nil {
-				return fmt.Errorf(
-					"Running migration\t[FAIL]\nStmt: %s\nErr: %v\n",
-					strings.TrimSpace(cmd), err)
-			} else if *verbose {
-				fmt.Println(strings.TrimSpace(cmd))
-			}
-			lastIndex = i + 1
-		}
+	if len(*to) != 0 && fs.NArg() > 0 {
+		exitLn("Error: Cannot give both a number of steps and -to")
 	}
-
-	return nil
+	return getStep(fs.Args()), *to
 }
 
 func getStep(args []string) int {
@@ -255,97 +186,3 @@ func getStep(args []string) int {
 	}
 	return step
 }
-
-func ensureRunMigrationsMatch(files, done []string) {
-	var i, j int
-	var filesLeft, doneLeft bool
-
-	for {
-		filesLeft, doneLeft = i < len(files), j < len(done)
-		if !filesLeft || !doneLeft {
-			break
-		}
-
-		if migFormat(files[i]) != done[j] {
-			exitf(errFmtNoMatch, done[j], filepath.Base(files[i]))
-		}
-		i, j = i+1, j+1
-	}
-
-	if doneLeft {
-		fmt.Println(errOutOfSync)
-		for _, mig := range done[j:] {
-			fmt.Printf("    %s\n", mig)
-		}
-	}
-}
-
-func getMigrationData() (SqlEngine, []string, []string, error) {
-	var engine SqlEngine
-	var files, done []string
-	var err error
-
-	if engine, err = NewEngine(config.Current); err != nil {
-		exitLn("Error getting handle to db:", err)
-	}
-
-	if err = engine.Open(); err != nil {
-		exitLn("Failed to connect to database.", err)
-	}
-
-	if files, err = getMigrations(); err != nil {
-		return nil, nil, nil, err
-	}
-
-	if done, err = getRunMigrations(engine); err != nil {
-		return nil, nil, nil, err
-	}
-
-	return engine, files, done, nil
-}
-
-func getMigrations() ([]string, error) {
-	var err error
-	paths := make([]string, 0)
-	path := filepath.Join(workingDir, _DATA_DIR, _MIG_DIR)
-	filepath.Walk(path, func(p string, fi os.FileInfo, e error) error {
-		if e != nil {
-			err = e
-			return e
-		}
-		if !fi.IsDir() && filepath.Ext(p) == ".sql" {
-			paths = append(paths, p)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	sort.Strings(paths)
-	return paths, nil
-}
-
-func getRunMigrations(engine SqlEngine) ([]string, error) {
-	paths := make([]string, 0)
-	result, err := engine.Query(
-		fmt.Sprintf("SELECT migration FROM %s;", _MIG_TABLE_NAME))
-	if err != nil {
-		return nil, err
-	}
-	for result.Next() {
-		var name string
-		if err := result.Scan(&name); err != nil {
-			return nil, err
-		}
-		paths = append(paths, name)
-	}
-	if err = result.Err(); err != nil {
-		return nil, err
-	}
-
-	return paths, nil
-}
-
-func migFormat(migrationfile string) string {
-	return strings.Split(filepath.Base(migrationfile), "_")[0]
-}
@@ -0,0 +1,647 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aarondl/dbm/config"
+	"github.com/aarondl/paths"
+
+	_ "code.google.com/p/go-sqlite/go1/sqlite3"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+const (
+	// _MIG_TABLE_NAME is the tracking table used unless one is configured.
+	_MIG_TABLE_NAME   = "tracked_migrations"
+	sqlUseDB          = `use %s;`
+	sqlCreateDB       = `CREATE DATABASE IF NOT EXISTS %s;`
+	sqlCreateDBPQ     = `CREATE DATABASE %s;`
+	sqlAddMig         = `INSERT INTO %s (migration, filename, checksum, applied_at, duration_ms) VALUES (?, ?, ?, ?, ?);`
+	sqlAddMigPQ       = `INSERT INTO %s (migration, filename, checksum, applied_at, duration_ms) VALUES ($1, $2, $3, $4, $5);`
+	sqlGetMigs        = `SELECT migration, filename, checksum, applied_at, duration_ms FROM %s ORDER BY migration;`
+	sqlGetMigsLegacy  = `SELECT migration, NULL, NULL, NULL, NULL FROM %s ORDER BY migration;`
+	sqlDelMig         = `DELETE FROM %s WHERE migration=?;`
+	sqlDelMigPQ       = `DELETE FROM %s WHERE migration=$1;`
+	sqlDropDB         = `DROP DATABASE IF EXISTS %s;`
+	sqlWipeTrackTable = `DELETE FROM %s;`
+	sqlBegin          = `BEGIN;`
+	sqlBeginMySQL     = `START TRANSACTION;`
+	sqlCommit         = `COMMIT;`
+	sqlScriptAddMig   = `INSERT INTO %s (migration, filename, checksum, applied_at) VALUES (%s, %s, %s, %s);`
+	sqlScriptDelMig   = `DELETE FROM %s WHERE migration=%s;`
+	sqlHasColumn      = `SELECT %s FROM %s WHERE 1=0;`
+	sqlAddColumn      = `ALTER TABLE %s ADD COLUMN %s %s;`
+	sqlCreateSchemaPQ = `CREATE SCHEMA IF NOT EXISTS %s;`
+	sqlLockPQ         = `SELECT pg_try_advisory_lock(hashtext($1));`
+	sqlUnlockPQ       = `SELECT pg_advisory_unlock(hashtext($1));`
+	sqlLockMySQL      = `SELECT GET_LOCK(?, ?);`
+	sqlUnlockMySQL    = `SELECT RELEASE_LOCK(?);`
+	sqlCreateLockTbl  = `CREATE TABLE IF NOT EXISTS %s (id integer PRIMARY KEY, locked_at varchar(32));`
+	sqlLockSqlite3    = `INSERT OR IGNORE INTO %s (id, locked_at) VALUES (1, ?);`
+	sqlUnlockSqlite3  = `DELETE FROM %s;`
+	sqlLockedSqlite3  = `SELECT locked_at FROM %s;`
+)
+
+// lockPoll is how often a lock that's held is tried again.
+const lockPoll = 250 * time.Millisecond
+
+const sqlCreateTrackTable = `
+CREATE TABLE IF NOT EXISTS %s (
+	migration varchar(255) NOT NULL,
+	filename varchar(255),
+	checksum varchar(64),
+	applied_at varchar(32),
+	duration_ms bigint
+);`
+
+// trackColumns are the columns that have been added to the tracking table
+// since it only held the migration, in the order they were added. Tables
+// created by older versions are upgraded by adding any that are missing.
+var trackColumns = [][2]string{
+	{"filename", "varchar(255)"},
+	{"checksum", "varchar(64)"},
+	{"applied_at", "varchar(32)"},
+	{"duration_ms", "bigint"},
+}
+
+// Expressions that give the current time in appliedAtLayout for scripts.
+const (
+	sqlNowMySQL   = `CONCAT(DATE_FORMAT(UTC_TIMESTAMP(6), '%Y-%m-%d %H:%i:%s.%f'), '000')`
+	sqlNowPQ      = `to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS.US') || '000'`
+	sqlNowSqlite3 = `strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'`
+)
+
+// appliedAtLayout is the format of the applied_at column. It's fixed width
+// and in UTC so that it sorts correctly as a string on every engine.
+const appliedAtLayout = "2006-01-02 15:04:05.000000000"
+
+// TrackedMigration is a record in the tracking table.
+type TrackedMigration struct {
+	// Migration is the version of the migration, see migFormat.
+	Migration string
+	// Filename is the full name of the migration file.
+	Filename string
+	// Checksum is the hex encoded sha256 of the up section.
+	Checksum string
+	// AppliedAt is the time the migration began to run.
+	AppliedAt time.Time
+	// Duration is how long the up section took to run.
+	Duration time.Duration
+}
+
+// rgxIdentifier matches the table and schema names that can be configured,
+// since they're used in statements without quoting.
+var rgxIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// NewEngine creates an engine for the kind of database in conf. useVcsRoot is
+// passed on to config.DB.Sqlite3Path to find sqlite3 databases. The password
+// is resolved here, see config.DB.ResolvePass.
+func NewEngine(conf *config.DB, useVcsRoot bool) (SqlEngine, error) {
+	if len(conf.Name) == 0 {
+		return nil, errors.New("dbm: Database must have a name.")
+	}
+	// Otherwise it'd panic when connecting.
+	if err := conf.ResolvePass(); err != nil {
+		return nil, err
+	}
+	if len(conf.Table) != 0 && !rgxIdentifier.MatchString(conf.Table) {
+		return nil, fmt.Errorf("dbm: Invalid table name: %s", conf.Table)
+	}
+	if len(conf.Schema) != 0 && !rgxIdentifier.MatchString(conf.Schema) {
+		return nil, fmt.Errorf("dbm: Invalid schema name: %s", conf.Schema)
+	}
+
+	switch conf.Kind {
+	case "mysql":
+		return NewMySQL(conf)
+	case "postgres":
+		return NewPostgres(conf)
+	case "sqlite3":
+		return NewSqlite3(conf, useVcsRoot)
+	default:
+		return nil, fmt.Errorf("dbm: Unknown db engine: %s", conf.Kind)
+	}
+}
+
+// SqlEngine is the database specific part of running migrations.
+type SqlEngine interface {
+	// CreateDB creates the database, does not require Open() first.
+	CreateDB() error
+	// DropDB drops the database, does not require Open() first.
+	DropDB() error
+
+	// Open the connection to the specified database.
+	Open() error
+	// Close the connection to the database.
+	Close() error
+	// Begin a transaction. No-op if the engine doesn't support it.
+	Begin() (*sql.Tx, error)
+	// Kind is the kind of database, as in config.DB.Kind.
+	Kind() string
+	// TransactionalDDL is true if schema changes can be rolled back.
+	TransactionalDDL() bool
+	// TrackTable is the name of the tracking table, including the schema if
+	// one is configured.
+	TrackTable() string
+	// Lock waits up to timeout to take a lock that only one migrator can hold
+	// for the tracking table, returning ErrLocked (or an error wrapping it)
+	// if it can't.
+	Lock(timeout time.Duration) error
+	// Unlock releases the lock taken by Lock.
+	Unlock() error
+	// CreateMigrationsTable adds a tracking table for migrations.
+	CreateMigrationsTable() error
+	// AddMigration adds a tracking record for a migration.
+	AddMigration(tx *sql.Tx, mig TrackedMigration) error
+	// DeleteMigration removes a tracking record for a migration.
+	DeleteMigration(tx *sql.Tx, mig string) error
+	// ScriptBegin returns the statement that begins a transaction in a script.
+	ScriptBegin() string
+	// ScriptAddMigration returns a statement that adds a tracking record for a
+	// migration when run as part of a script outside of dbm.
+	ScriptAddMigration(mig TrackedMigration) string
+	// ScriptDeleteMigration returns a statement that removes a tracking record
+	// for a migration when run as part of a script outside of dbm.
+	ScriptDeleteMigration(mig string) string
+	// Exec executes a statement against the database.
+	Exec(stmt string, args ...interface{}) (sql.Result, error)
+	// Query executes a query against the database.
+	Query(stmt string, args ...interface{}) (*sql.Rows, error)
+}
+
+type MySQL struct {
+	conf *config.DB
+	*sql.DB
+	table string
+	lock  *sql.Conn
+}
+
+func NewMySQL(d *config.DB) (*MySQL, error) {
+	return &MySQL{conf: d, table: trackTable(d)}, nil
+}
+
+func (m *MySQL) Open() error {
+	var err error
+	m.DB, err = sql.Open("mysql", m.conf.DSN())
+	return err
+}
+
+func (m *MySQL) CreateDB() error {
+	var err error
+	if m.DB, err = sql.Open("mysql", m.conf.DSNnoDB()); err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if _, err := m.Exec(fmt.Sprintf(sqlCreateDB, m.conf.Name)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *MySQL) DropDB() error {
+	var err error
+	if m.DB, err = sql.Open("mysql", m.conf.DSNnoDB()); err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if _, err = m.Exec(fmt.Sprintf(sqlDropDB, m.conf.Name)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *MySQL) Kind() string {
+	return "mysql"
+}
+
+func (m *MySQL) TransactionalDDL() bool {
+	return false
+}
+
+func (m *MySQL) TrackTable() string {
+	return m.table
+}
+
+// Lock takes a named lock, which belongs to the connection that took it so
+// one is kept aside until Unlock.
+func (m *MySQL) Lock(timeout time.Duration) error {
+	conn, err := m.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// GET_LOCK waits by itself and returns 0 if it timed out.
+	var ok sql.NullInt64
+	seconds := int64((timeout + time.Second - 1) / time.Second)
+	err = conn.QueryRowContext(context.Background(), sqlLockMySQL,
+		m.lockName(), seconds).Scan(&ok)
+	if err == nil && ok.Int64 != 1 {
+		err = ErrLocked
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	m.lock = conn
+	return nil
+}
+
+func (m *MySQL) Unlock() error {
+	if m.lock == nil {
+		return nil
+	}
+	defer func() { m.lock = nil }()
+	defer m.lock.Close()
+
+	_, err := m.lock.ExecContext(context.Background(), sqlUnlockMySQL,
+		m.lockName())
+	return err
+}
+
+// lockName is unique to the tracking table, lock names in MySQL are shared
+// by every database on the server.
+func (m *MySQL) lockName() string {
+	return "dbm:" + m.conf.Name + "." + m.table
+}
+
+func (m *MySQL) CreateMigrationsTable() error {
+	return createTrackTable(m)
+}
+
+func (m *MySQL) AddMigration(tx *sql.Tx, mig TrackedMigration) error {
+	return insertTrackTable(tx, sqlAddMig, m.table, mig)
+}
+
+func (m *MySQL) DeleteMigration(tx *sql.Tx, mig string) error {
+	return deleteTrackTable(tx, sqlDelMig, m.table, mig)
+}
+
+func (m *MySQL) ScriptBegin() string {
+	return sqlBeginMySQL
+}
+
+func (m *MySQL) ScriptAddMigration(mig TrackedMigration) string {
+	return scriptAddTrackTable(m.table, mig, quoteMySQL, sqlNowMySQL)
+}
+
+func (m *MySQL) ScriptDeleteMigration(mig string) string {
+	return scriptDeleteTrackTable(m.table, mig, quoteMySQL)
+}
+
+type Postgres struct {
+	conf *config.DB
+	*sql.DB
+	table string
+	lock  *sql.Conn
+}
+
+func NewPostgres(d *config.DB) (*Postgres, error) {
+	return &Postgres{conf: d, table: trackTable(d)}, nil
+}
+
+func (p *Postgres) Open() error {
+	var err error
+	p.DB, err = sql.Open("postgres", p.conf.DSN())
+	return err
+}
+
+func (p *Postgres) CreateDB() error {
+	var err error
+	if p.DB, err = sql.Open("postgres", p.conf.DSNnoDB()); err != nil {
+		return err
+	}
+	defer p.Close()
+
+	if _, err := p.Exec(fmt.Sprintf(sqlCreateDBPQ, p.conf.Name)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *Postgres) DropDB() error {
+	var err error
+	if p.DB, err = sql.Open("postgres", p.conf.DSNnoDB()); err != nil {
+		return err
+	}
+	defer p.Close()
+
+	if _, err = p.Exec(fmt.Sprintf(sqlDropDB, p.conf.Name)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *Postgres) Kind() string {
+	return "postgres"
+}
+
+func (p *Postgres) TransactionalDDL() bool {
+	return true
+}
+
+func (p *Postgres) TrackTable() string {
+	return p.table
+}
+
+// Lock takes an advisory lock, which belongs to the connection that took it
+// so one is kept aside until Unlock.
+func (p *Postgres) Lock(timeout time.Duration) error {
+	conn, err := p.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+
+	err = pollLock(timeout, func() (bool, error) {
+		var ok bool
+		err := conn.QueryRowContext(context.Background(), sqlLockPQ,
+			p.table).Scan(&ok)
+		return ok, err
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.lock = conn
+	return nil
+}
+
+func (p *Postgres) Unlock() error {
+	if p.lock == nil {
+		return nil
+	}
+	defer func() { p.lock = nil }()
+	defer p.lock.Close()
+
+	_, err := p.lock.ExecContext(context.Background(), sqlUnlockPQ, p.table)
+	return err
+}
+
+func (p *Postgres) CreateMigrationsTable() error {
+	if len(p.conf.Schema) != 0 {
+		if _, err := p.Exec(fmt.Sprintf(sqlCreateSchemaPQ, p.conf.Schema)); err != nil {
+			return err
+		}
+	}
+	return createTrackTable(p)
+}
+
+func (p *Postgres) AddMigration(tx *sql.Tx, mig TrackedMigration) error {
+	return insertTrackTable(tx, sqlAddMigPQ, p.table, mig)
+}
+
+func (p *Postgres) DeleteMigration(tx *sql.Tx, mig string) error {
+	return deleteTrackTable(tx, sqlDelMigPQ, p.table, mig)
+}
+
+func (p *Postgres) ScriptBegin() string {
+	return sqlBegin
+}
+
+func (p *Postgres) ScriptAddMigration(mig TrackedMigration) string {
+	return scriptAddTrackTable(p.table, mig, quoteSQL, sqlNowPQ)
+}
+
+func (p *Postgres) ScriptDeleteMigration(mig string) string {
+	return scriptDeleteTrackTable(p.table, mig, quoteSQL)
+}
+
+type Sqlite3 struct {
+	conf *config.DB
+	*sql.DB
+	path  string
+	table string
+}
+
+func NewSqlite3(d *config.DB, useVcsRoot bool) (*Sqlite3, error) {
+	path, err := d.Sqlite3Path(useVcsRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &Sqlite3{
+		conf:  d,
+		path:  path,
+		table: trackTable(d),
+	}, nil
+}
+
+func (s *Sqlite3) Open() error {
+	var err error
+	s.DB, err = sql.Open("sqlite3", s.path)
+	return err
+}
+
+func (s *Sqlite3) CreateDB() error {
+	dir := filepath.Dir(s.path)
+	if _, err := paths.EnsureDirectory(dir); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Sqlite3) DropDB() error {
+	return os.Remove(s.path)
+}
+
+func (s *Sqlite3) Kind() string {
+	return "sqlite3"
+}
+
+func (s *Sqlite3) TransactionalDDL() bool {
+	return true
+}
+
+func (s *Sqlite3) TrackTable() string {
+	return s.table
+}
+
+// Lock inserts the only row a lock table can hold. Sqlite3 has no locks that
+// outlive a transaction, so if dbm is killed while migrating the row has to be
+// deleted by hand. The error when it times out says so, with when the row was
+// inserted.
+func (s *Sqlite3) Lock(timeout time.Duration) error {
+	table := s.lockTable()
+	if _, err := s.Exec(fmt.Sprintf(sqlCreateLockTbl, table)); err != nil {
+		return err
+	}
+
+	err := pollLock(timeout, func() (bool, error) {
+		// Nothing is inserted while the row is already there.
+		result, err := s.Exec(fmt.Sprintf(sqlLockSqlite3, table),
+			time.Now().UTC().Format(appliedAtLayout))
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n == 1, err
+	})
+	if err != ErrLocked {
+		return err
+	}
+
+	var lockedAt string
+	row := s.QueryRow(fmt.Sprintf(sqlLockedSqlite3, table))
+	if err := row.Scan(&lockedAt); err != nil {
+		// It was released since the last try.
+		return ErrLocked
+	}
+	return fmt.Errorf("%w, locked at %s. If that dbm was killed, release "+
+		"the lock with: DELETE FROM %s;", ErrLocked, lockedAt, table)
+}
+
+func (s *Sqlite3) Unlock() error {
+	_, err := s.Exec(fmt.Sprintf(sqlUnlockSqlite3, s.lockTable()))
+	return err
+}
+
+func (s *Sqlite3) lockTable() string {
+	return s.table + "_lock"
+}
+
+func (s *Sqlite3) CreateMigrationsTable() error {
+	return createTrackTable(s)
+}
+
+func (s *Sqlite3) AddMigration(tx *sql.Tx, mig TrackedMigration) error {
+	return insertTrackTable(tx, sqlAddMig, s.table, mig)
+}
+
+func (s *Sqlite3) DeleteMigration(tx *sql.Tx, mig string) error {
+	return deleteTrackTable(tx, sqlDelMig, s.table, mig)
+}
+
+func (s *Sqlite3) ScriptBegin() string {
+	return sqlBegin
+}
+
+func (s *Sqlite3) ScriptAddMigration(mig TrackedMigration) string {
+	return scriptAddTrackTable(s.table, mig, quoteSQL, sqlNowSqlite3)
+}
+
+func (s *Sqlite3) ScriptDeleteMigration(mig string) string {
+	return scriptDeleteTrackTable(s.table, mig, quoteSQL)
+}
+
+// pollLock calls try until it takes the lock, returning ErrLocked if that
+// doesn't happen before timeout.
+func pollLock(timeout time.Duration, try func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := try()
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// trackTable is the name of the tracking table configured in d.
+func trackTable(d *config.DB) string {
+	table := d.Table
+	if len(table) == 0 {
+		table = _MIG_TABLE_NAME
+	}
+	if len(d.Schema) != 0 {
+		table = d.Schema + "." + table
+	}
+	return table
+}
+
+func createTrackTable(engine SqlEngine) error {
+	var err error
+	table := engine.TrackTable()
+	if _, err = engine.Exec(fmt.Sprintf(sqlCreateTrackTable, table)); err != nil {
+		return err
+	}
+	if _, err = engine.Exec(fmt.Sprintf(sqlWipeTrackTable, table)); err != nil {
+		return err
+	}
+	return upgradeTrackTable(engine)
+}
+
+// upgradeTrackTable adds any columns missing from a tracking table that was
+// created by an older version.
+func upgradeTrackTable(engine SqlEngine) error {
+	for _, col := range missingTrackColumns(engine) {
+		_, err := engine.Exec(
+			fmt.Sprintf(sqlAddColumn, engine.TrackTable(), col[0], col[1]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingTrackColumns returns the columns a tracking table created by an older
+// version doesn't have yet.
+func missingTrackColumns(engine SqlEngine) [][2]string {
+	var missing [][2]string
+	for _, col := range trackColumns {
+		_, err := engine.Exec(
+			fmt.Sprintf(sqlHasColumn, col[0], engine.TrackTable()))
+		if err != nil {
+			missing = append(missing, col)
+		}
+	}
+	return missing
+}
+
+func insertTrackTable(tx *sql.Tx, sql, table string, mig TrackedMigration) error {
+	_, err := tx.Exec(fmt.Sprintf(sql, table),
+		mig.Migration,
+		mig.Filename,
+		mig.Checksum,
+		mig.AppliedAt.UTC().Format(appliedAtLayout),
+		int64(mig.Duration/time.Millisecond),
+	)
+	return err
+}
+
+func deleteTrackTable(tx *sql.Tx, sql, table, mig string) error {
+	_, err := tx.Exec(fmt.Sprintf(sql, table), mig)
+	return err
+}
+
+// scriptAddTrackTable creates an insert into the tracking table with the
+// values inlined. The time it's applied comes from the database's clock when
+// the script is run, the duration is unknown.
+func scriptAddTrackTable(table string, mig TrackedMigration,
+	quote func(string) string, now string) string {
+
+	return fmt.Sprintf(sqlScriptAddMig, table,
+		quote(mig.Migration), quote(mig.Filename), quote(mig.Checksum), now)
+}
+
+func scriptDeleteTrackTable(table, mig string, quote func(string) string) string {
+	return fmt.Sprintf(sqlScriptDelMig, table, quote(mig))
+}
+
+// quoteSQL quotes a string literal the standard way.
+func quoteSQL(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// quoteMySQL quotes a string literal for MySQL which also treats backslashes
+// as escapes.
+func quoteMySQL(s string) string {
+	return quoteSQL(strings.Replace(s, `\`, `\\`, -1))
+}
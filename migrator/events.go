@@ -0,0 +1,65 @@
+package migrator
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// Event describes a migration that was run or rolled back, see
+// Migrator.Events.
+type Event struct {
+	// Migration is the name of the migration file.
+	Migration string
+	// Rollback is true if the migration was rolled back.
+	Rollback bool
+	// Statements are the statements that were run successfully, in order.
+	// Go migrations don't have any.
+	Statements []string
+	// Duration is how long the migration took.
+	Duration time.Duration
+	// Err is why the migration failed, if it did. It's a *StatementError when
+	// a statement failed. With Atomic the events are sent once the batch's
+	// transaction has ended, and migrations that were rolled back with the
+	// rest of the batch get an error saying why.
+	Err error
+}
+
+func (m *Migrator) event(migration string, rollback bool, l loadedMigration,
+	start time.Time, err error) {
+
+	if m.Events == nil {
+		return
+	}
+	m.Events(newEvent(migration, rollback, l, start, err))
+}
+
+// flushEvents sends the events buffered for an Atomic batch once its
+// transaction has ended with batchErr.
+func (m *Migrator) flushEvents(events []Event, batchErr error) {
+	if m.Events == nil {
+		return
+	}
+
+	for _, e := range events {
+		if batchErr != nil && e.Err == nil {
+			e.Err = fmt.Errorf("Rolled back with the batch: %v", batchErr)
+		}
+		m.Events(e)
+	}
+}
+
+func newEvent(migration string, rollback bool, l loadedMigration,
+	start time.Time, err error) Event {
+
+	e := Event{
+		Migration: path.Base(migration),
+		Rollback:  rollback,
+		Duration:  time.Since(start),
+		Err:       err,
+	}
+	if l.stmts != nil {
+		e.Statements = *l.stmts
+	}
+	return e
+}
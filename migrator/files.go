@@ -0,0 +1,633 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Separator is the line that separates the up and down sections of a
+// migration file.
+const Separator = "!========================!"
+
+// directiveNoTx in the header of a migration file runs it outside of a
+// transaction.
+const directiveNoTx = "dbm:no-transaction"
+
+// Everything between lines with these directives is run as a single
+// statement without being parsed, for SQL the splitter gets wrong.
+const (
+	directiveStmtBegin = "dbm:statement-begin"
+	directiveStmtEnd   = "dbm:statement-end"
+)
+
+// sqlExecer exists for test stubbing and dry runs.
+type sqlExecer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+// blockExecer is implemented by execers that print statements instead of
+// running them, for the statements that can't be split at ; again when the
+// output is run.
+type blockExecer interface {
+	ExecBlock(stmt string) (sql.Result, error)
+}
+
+// printExecer prints the statements it's given instead of running them. kind
+// is the kind of database in config.DB.Kind they're printed for.
+type printExecer struct {
+	w    io.Writer
+	kind string
+}
+
+func (p printExecer) Exec(stmt string, args ...interface{}) (sql.Result, error) {
+	_, err := fmt.Fprintln(p.w, terminate(strings.TrimSpace(stmt), ";"))
+	return driver.RowsAffected(0), err
+}
+
+// ExecBlock prints a statement with DELIMITER lines around it so the mysql
+// client doesn't split it at the ; inside. Other databases have no DELIMITER,
+// so it's printed between statement-begin and statement-end lines instead.
+func (p printExecer) ExecBlock(stmt string) (sql.Result, error) {
+	stmt = strings.TrimSpace(stmt)
+	if p.kind != "mysql" {
+		_, err := fmt.Fprintf(p.w, "-- %s\n%s\n-- %s\n", directiveStmtBegin,
+			terminate(stmt, ";"), directiveStmtEnd)
+		return driver.RowsAffected(0), err
+	}
+
+	delim := "//"
+	for strings.Contains(stmt, delim) {
+		delim += "/"
+	}
+	_, err := fmt.Fprintf(p.w, "DELIMITER %s\n%s\nDELIMITER ;\n", delim,
+		terminate(stmt, delim))
+	return driver.RowsAffected(0), err
+}
+
+// terminate adds term to a statement that doesn't end with it, like the last
+// statement of a migration can, so it doesn't run into the next one when
+// printed. term goes on its own line if the statement ends in a comment.
+func terminate(stmt, term string) string {
+	if strings.HasSuffix(stmt, term) {
+		return stmt
+	}
+	last := stmt[strings.LastIndexByte(stmt, '\n')+1:]
+	if strings.Contains(last, "--") || strings.Contains(last, "#") {
+		return stmt + "\n" + term
+	}
+	return stmt + term
+}
+
+// logExecer logs each statement after it's been run successfully.
+type logExecer struct {
+	sqlExecer
+	w io.Writer
+}
+
+func (l logExecer) Exec(stmt string, args ...interface{}) (sql.Result, error) {
+	result, err := l.sqlExecer.Exec(stmt, args...)
+	if err == nil {
+		fmt.Fprintln(l.w, strings.TrimSpace(stmt))
+	}
+	return result, err
+}
+
+// recordExecer keeps each statement after it's been run successfully.
+type recordExecer struct {
+	sqlExecer
+	stmts *[]string
+}
+
+func (r recordExecer) Exec(stmt string, args ...interface{}) (sql.Result, error) {
+	result, err := r.sqlExecer.Exec(stmt, args...)
+	if err == nil {
+		*r.stmts = append(*r.stmts, strings.TrimSpace(stmt))
+	}
+	return result, err
+}
+
+// execer records the statements of l run by exec, and logs them when verbose.
+func (m *Migrator) execer(exec sqlExecer, l loadedMigration) sqlExecer {
+	if m.Verbose {
+		exec = logExecer{exec, m.logWriter()}
+	}
+	return recordExecer{exec, l.stmts}
+}
+
+// StatementError is returned when a statement in a migration fails.
+type StatementError struct {
+	// Stmt is the statement that failed.
+	Stmt string
+	// Line is the line of the migration file the statement starts on.
+	Line int
+	// Err is the error from the database.
+	Err error
+}
+
+func (s *StatementError) Error() string {
+	return fmt.Sprintf("Running migration\t[FAIL]\nLine: %d\nStmt: %s\nErr: %v\n",
+		s.Line, s.Stmt, s.Err)
+}
+
+func (s *StatementError) Unwrap() error {
+	return s.Err
+}
+
+// migrationOptions are set by directives in the comments at the top of a
+// migration file, before any statements.
+type migrationOptions struct {
+	// noTransaction runs the statements directly against the database for
+	// those that can't be run inside a transaction. The tracking table is
+	// updated afterwards.
+	noTransaction bool
+}
+
+func getMigrationParts(source fs.FS, filename string) ([]byte, []byte, migrationOptions, error) {
+	var opts migrationOptions
+	shortname := path.Base(filename)
+
+	f, err := source.Open(filename)
+	if err != nil {
+		return nil, nil, opts, fmt.Errorf("Could not open file: %s - %v",
+			shortname, err)
+	}
+	defer f.Close()
+
+	var up, down bytes.Buffer
+	var sep = []byte(Separator)
+	var doingDown = false
+	var doingHeader = true
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if bytes.Equal(sep, scanner.Bytes()) {
+			doingDown = true
+			doingHeader = false
+			continue
+		}
+
+		if doingHeader {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "--") {
+				switch strings.TrimSpace(line[2:]) {
+				case directiveNoTx:
+					opts.noTransaction = true
+				}
+			} else if len(line) != 0 {
+				doingHeader = false
+			}
+		}
+
+		if doingDown {
+			down.Write(scanner.Bytes())
+			down.WriteByte('\n')
+		} else {
+			up.Write(scanner.Bytes())
+			up.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, opts, fmt.Errorf("Failed to read file: %s - %v",
+			shortname, err)
+	}
+
+	return up.Bytes(), down.Bytes(), opts, nil
+}
+
+// escapes is how a kind of database escapes characters inside quotes, besides
+// doubling the quote which they all understand.
+type escapes int
+
+const (
+	// escapeStandard has no other escapes, like Sqlite3.
+	escapeStandard escapes = iota
+	// escapeBackslash escapes the next character with \ in ' and " quotes,
+	// like MySQL.
+	escapeBackslash
+	// escapeStringConst escapes the next character with \ only in E'' string
+	// constants, like Postgres.
+	escapeStringConst
+)
+
+// kindEscapes returns the escapes used by the kind of database in
+// config.DB.Kind.
+func kindEscapes(kind string) escapes {
+	switch kind {
+	case "mysql":
+		return escapeBackslash
+	case "postgres":
+		return escapeStringConst
+	default:
+		return escapeStandard
+	}
+}
+
+// downLine is the line of the migration file that the down section starts on,
+// after the up section and the separator.
+func downLine(up []byte) int {
+	return bytes.Count(up, []byte{'\n'}) + 2
+}
+
+// runMigrationPart splits part into statements and runs each of them. line is
+// the line of the migration file part starts on, for errors, and kind is the
+// kind of database in config.DB.Kind whose rules are used to split them. A
+// statement at the end without a terminator is run as well, but a quote or
+// comment that's never closed is an error.
+func runMigrationPart(exec sqlExecer, part []byte, line int, kind string) error {
+	esc := kindEscapes(kind)
+	var quote, dblQuote, backQuote bool
+	// quoteStart is where the open quote began.
+	var quoteStart int
+	// backslash is true when \ escapes characters in the open quote.
+	var backslash bool
+	// delim ends statements in place of ; after a DELIMITER line.
+	var delim []byte
+
+	lineAt := func(i int) int {
+		return line + bytes.Count(part[:i], []byte{'\n'})
+	}
+	unterminated := func(what string, i int) error {
+		return fmt.Errorf("Line %d: Unterminated %s", lineAt(i), what)
+	}
+
+	lastIndex := 0
+	// run runs a statement, block is true if it can contain ; that don't end
+	// it.
+	run := func(cmd []byte, block bool) error {
+		// The statement's line is where it starts after any blank lines.
+		start := lastIndex + len(cmd) - len(bytes.TrimLeft(cmd, " \t\r\n"))
+		var err error
+		if b, ok := exec.(blockExecer); ok && block {
+			_, err = b.ExecBlock(string(cmd))
+		} else {
+			_, err = exec.Exec(string(cmd))
+		}
+		if err != nil {
+			return &StatementError{
+				Stmt: strings.TrimSpace(string(cmd)),
+				Line: lineAt(start),
+				Err:  err,
+			}
+		}
+		return nil
+	}
+	// runPending runs what's been seen since the last statement, if there's
+	// more than comments.
+	runPending := func(i int) error {
+		if lastIndex >= i || isBlank(part[lastIndex:i]) {
+			return nil
+		}
+		return run(part[lastIndex:i], delim != nil)
+	}
+
+	for i := 0; i < len(part); i++ {
+		inQuote := quote || dblQuote || backQuote
+		if !inQuote && (i == 0 || part[i-1] == '\n') {
+			if d, end := lineDirective(part, i); d == directiveStmtBegin {
+				if err := runPending(i); err != nil {
+					return err
+				}
+				stmt, stmtEnd := statementBlock(part, end+1)
+				if stmtEnd < 0 {
+					return fmt.Errorf("Line %d: Missing %s after %s",
+						lineAt(i), directiveStmtEnd, directiveStmtBegin)
+				}
+				lastIndex = end + 1
+				if err := run(stmt, true); err != nil {
+					return err
+				}
+				i = stmtEnd
+				lastIndex = stmtEnd + 1
+				continue
+			}
+
+			// Like the mysql client, DELIMITER lines at the start of a
+			// statement change what ends one so that procedures and triggers
+			// can contain ; It's only for MySQL, other databases use
+			// DELIMITER as a keyword.
+			d, end := delimiterDirective(part, i)
+			if d != nil && kind == "mysql" &&
+				(lastIndex >= i || isBlank(part[lastIndex:i])) {
+				delim = d
+				if string(delim) == ";" {
+					delim = nil
+				}
+				i = end
+				lastIndex = end + 1
+				continue
+			}
+		}
+		if !inQuote && delim != nil && bytes.HasPrefix(part[i:], delim) {
+			// The delimiter isn't part of the statement.
+			if err := runPending(i); err != nil {
+				return err
+			}
+			i += len(delim) - 1
+			lastIndex = i + 1
+			continue
+		}
+
+		switch part[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case '\'':
+			if dblQuote || backQuote {
+				break
+			}
+			if !quote {
+				quote = true
+				quoteStart = i
+				backslash = esc == escapeBackslash ||
+					esc == escapeStringConst && isStringConst(part, i)
+				break
+			}
+			// A doubled quote is an escaped quote, not the end of the string.
+			if i+1 < len(part) && part[i+1] == '\'' {
+				i++
+				break
+			}
+			quote, backslash = false, false
+		case '"':
+			if quote || backQuote {
+				break
+			}
+			if !dblQuote {
+				dblQuote = true
+				quoteStart = i
+				backslash = esc == escapeBackslash
+				break
+			}
+			if i+1 < len(part) && part[i+1] == '"' {
+				i++
+				break
+			}
+			dblQuote, backslash = false, false
+		case '`':
+			if quote || dblQuote {
+				break
+			}
+			backQuote = !backQuote
+			quoteStart = i
+		case '-':
+			if i+1 >= len(part) || part[i+1] != '-' {
+				break
+			}
+			fallthrough
+		case '#':
+			if quote || dblQuote || backQuote {
+				break
+			}
+			i = lineEnd(part, i)
+		case '/':
+			if quote || dblQuote || backQuote {
+				break
+			}
+			if i+1 < len(part) && part[i+1] == '*' {
+				end := bytes.Index(part[i+2:], []byte("*/"))
+				if end < 0 {
+					return unterminated("comment", i)
+				}
+				i += 2 + end + 1
+			}
+		case '$':
+			if quote || dblQuote || backQuote || kind != "postgres" {
+				break
+			}
+			// Postgres dollar quoted strings like $$...$$ or $tag$...$tag$
+			// are skipped over whole since they're usually function bodies
+			// full of semicolons. Elsewhere $ can be part of a name.
+			tag := dollarTag(part, i)
+			if tag == nil {
+				break
+			}
+			end := bytes.Index(part[i+len(tag):], tag)
+			if end < 0 {
+				return unterminated("dollar quote "+string(tag), i)
+			}
+			i += len(tag) + end + len(tag) - 1
+		case ';':
+			if quote || dblQuote || backQuote || delim != nil {
+				break
+			}
+			if err := run(part[lastIndex:i+1], false); err != nil {
+				return err
+			}
+			lastIndex = i + 1
+		}
+	}
+
+	switch {
+	case quote:
+		return unterminated("quote '", quoteStart)
+	case dblQuote:
+		return unterminated(`quote "`, quoteStart)
+	case backQuote:
+		return unterminated("quote `", quoteStart)
+	}
+
+	return runPending(len(part))
+}
+
+// isStringConst is true if the quote at part[i] begins a Postgres E” string
+// constant.
+func isStringConst(part []byte, i int) bool {
+	if i < 1 || (part[i-1] != 'E' && part[i-1] != 'e') {
+		return false
+	}
+	return i < 2 || !isIdentByte(part[i-2])
+}
+
+// isBlank is true if there's nothing but whitespace and comments in b.
+func isBlank(b []byte) bool {
+	for i := 0; i < len(b); i++ {
+		switch {
+		case b[i] == ' ' || b[i] == '\t' || b[i] == '\r' || b[i] == '\n':
+		case b[i] == '#' || bytes.HasPrefix(b[i:], []byte("--")):
+			i = lineEnd(b, i)
+		case bytes.HasPrefix(b[i:], []byte("/*")):
+			end := bytes.Index(b[i+2:], []byte("*/"))
+			if end < 0 {
+				return false
+			}
+			i += 2 + end + 1
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// lineDirective returns the directive in a -- comment that's the whole line
+// starting at part[i], and the index of the end of the line. The directive is
+// empty if the line isn't a comment.
+func lineDirective(part []byte, i int) (string, int) {
+	end := lineEnd(part, i)
+	line := bytes.TrimSpace(part[i:end])
+	if !bytes.HasPrefix(line, []byte("--")) {
+		return "", end
+	}
+	return string(bytes.TrimSpace(line[2:])), end
+}
+
+// statementBlock returns the lines from part[i] up to the statement-end
+// directive, and the index of the end of the directive's line. The index is
+// -1 if there's no statement-end.
+func statementBlock(part []byte, i int) ([]byte, int) {
+	for j := i; j < len(part); j++ {
+		d, end := lineDirective(part, j)
+		if d == directiveStmtEnd {
+			return part[i:j], end
+		}
+		j = end
+	}
+	return nil, -1
+}
+
+// lineEnd returns the index of the newline ending the line part[i] is on, or
+// len(part) if it's the last line.
+func lineEnd(part []byte, i int) int {
+	if i > len(part) {
+		return len(part)
+	}
+	end := bytes.IndexByte(part[i:], '\n')
+	if end < 0 {
+		return len(part)
+	}
+	return end + i
+}
+
+// delimiterDirective checks for a DELIMITER line starting at part[i],
+// returning the new delimiter and the index of the end of the line. The
+// delimiter is nil if the line isn't one.
+func delimiterDirective(part []byte, i int) ([]byte, int) {
+	end := lineEnd(part, i)
+
+	const keyword = "DELIMITER"
+	line := bytes.TrimLeft(part[i:end], " \t")
+	if len(line) <= len(keyword) ||
+		!bytes.EqualFold(line[:len(keyword)], []byte(keyword)) ||
+		(line[len(keyword)] != ' ' && line[len(keyword)] != '\t') {
+		return nil, 0
+	}
+
+	delim := bytes.TrimSpace(line[len(keyword):])
+	if len(delim) == 0 {
+		return nil, 0
+	}
+	return delim, end
+}
+
+// dollarTag returns the dollar quote tag that starts at part[i], like $$ or
+// $tag$, or nil if there isn't one. A $ that's part of an identifier or a
+// parameter like $1 doesn't start a tag.
+func dollarTag(part []byte, i int) []byte {
+	if i > 0 && isIdentByte(part[i-1]) {
+		return nil
+	}
+
+	for j := i + 1; j < len(part); j++ {
+		switch c := part[j]; {
+		case c == '$':
+			return part[i : j+1]
+		case c >= '0' && c <= '9':
+			if j == i+1 {
+				return nil
+			}
+		case !isIdentByte(c):
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// getMigrations finds the migration files in source, the names returned are
+// relative to its root.
+func getMigrations(source fs.FS) ([]string, error) {
+	var err error
+	paths := make([]string, 0)
+	fs.WalkDir(source, ".", func(p string, d fs.DirEntry, e error) error {
+		if e != nil {
+			err = e
+			return e
+		}
+		if !d.IsDir() && path.Ext(p) == ".sql" {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func getRunMigrations(engine SqlEngine) ([]TrackedMigration, error) {
+	// The tracking table isn't always upgraded, so it may be missing
+	// everything but the migration.
+	query := sqlGetMigs
+	if len(missingTrackColumns(engine)) != 0 {
+		query = sqlGetMigsLegacy
+	}
+
+	migs := make([]TrackedMigration, 0)
+	result, err := engine.Query(fmt.Sprintf(query, engine.TrackTable()))
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var mig TrackedMigration
+		var filename, checksum, appliedAt sql.NullString
+		var duration sql.NullInt64
+		err := result.Scan(&mig.Migration, &filename, &checksum, &appliedAt,
+			&duration)
+		if err != nil {
+			return nil, err
+		}
+
+		mig.Filename = filename.String
+		mig.Checksum = checksum.String
+		mig.Duration = time.Duration(duration.Int64) * time.Millisecond
+		if appliedAt.Valid {
+			mig.AppliedAt, err = time.Parse(appliedAtLayout, appliedAt.String)
+			if err != nil {
+				return nil, err
+			}
+		}
+		migs = append(migs, mig)
+	}
+	if err = result.Err(); err != nil {
+		return nil, err
+	}
+
+	return migs, nil
+}
+
+// checksum is the hex encoded sha256 of a migration part.
+func checksum(part []byte) string {
+	sum := sha256.Sum256(part)
+	return hex.EncodeToString(sum[:])
+}
+
+func migFormat(migrationfile string) string {
+	return strings.Split(path.Base(migrationfile), "_")[0]
+}
@@ -0,0 +1,335 @@
+package migrator
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	. "testing"
+	"testing/fstest"
+)
+
+type fakeTx struct {
+	cmds []string
+}
+
+func makeFakeTx() *fakeTx {
+	return &fakeTx{
+		make([]string, 0),
+	}
+}
+
+func (f *fakeTx) Exec(cmd string, args ...interface{}) (sql.Result, error) {
+	f.cmds = append(f.cmds, cmd)
+	return nil, nil
+}
+
+var partTests = []struct {
+	Part   string
+	Expect []string
+}{
+	{
+		"a /* b;\n */; c;",
+		[]string{"a /* b;\n */;", " c;"},
+	},
+	{
+		"a--b;\nc;d;",
+		[]string{"a--b;\nc;", "d;"},
+	},
+	{
+		"a#b;\nc;d;",
+		[]string{"a#b;\nc;", "d;"},
+	},
+	{
+		"a'/*--;#`\"';b;",
+		[]string{"a'/*--;#`\"';", "b;"},
+	},
+	{
+		"a\"/*--;#`'\";b;",
+		[]string{"a\"/*--;#`'\";", "b;"},
+	},
+	{
+		"a`/*--;#'\"`;b;",
+		[]string{"a`/*--;#'\"`;", "b;"},
+	},
+	{
+		"CREATE FUNCTION f() AS $$ BEGIN a; b; END; $$ LANGUAGE plpgsql;c;",
+		[]string{"CREATE FUNCTION f() AS $$ BEGIN a; b; END; $$ LANGUAGE plpgsql;", "c;"},
+	},
+	{
+		"DO $body$ a; '$$'; $b$; $body$;c;",
+		[]string{"DO $body$ a; '$$'; $b$; $body$;", "c;"},
+	},
+	{
+		"a$$ '; $$;b';c;",
+		[]string{"a$$ '; $$;b';", "c;"},
+	},
+	{
+		"SELECT $1; SELECT $2;",
+		[]string{"SELECT $1;", " SELECT $2;"},
+	},
+	{
+		"a'$$';b;$$;$$;",
+		[]string{"a'$$';", "b;", "$$;$$;"},
+	},
+	{
+		"COPY t (a, b) FROM '/tmp/x.csv'\n  DELIMITER ',' CSV;\nSELECT 1;",
+		[]string{"COPY t (a, b) FROM '/tmp/x.csv'\n  DELIMITER ',' CSV;",
+			"\nSELECT 1;"},
+	},
+	{
+		"a;\n-- dbm:statement-begin\nb 'c; d;\n/* e;\n" +
+			"  --   dbm:statement-end\nf;",
+		[]string{"a;", "b 'c; d;\n/* e;\n", "f;"},
+	},
+	{
+		"-- dbm:statement-begin\na;\n-- dbm:statement-end",
+		[]string{"a;\n"},
+	},
+	{
+		"a;\nb -- c;",
+		[]string{"a;", "\nb -- c;"},
+	},
+	{
+		"a;\n -- b;\n/* c; */\n# d\n",
+		[]string{"a;"},
+	},
+}
+
+func Test_RunMigrationPart(t *T) {
+	for _, test := range partTests {
+		tx := makeFakeTx()
+		if err := runMigrationPart(tx, []byte(test.Part), 1, "postgres"); err != nil {
+			t.Errorf("%#v: %v", test.Part, err)
+		}
+
+		if len(tx.cmds) != len(test.Expect) {
+			t.Errorf("Test failed: %#v", test.Part)
+			t.Errorf("Expect: %#v\n", test.Expect)
+			t.Errorf("Result: %#v\n", tx.cmds)
+		}
+
+		for i := 0; i < len(tx.cmds); i++ {
+			if tx.cmds[i] != test.Expect[i] {
+				t.Errorf("Test failed: %#v", test.Part)
+				t.Errorf("Expect: %#v\n", test.Expect[i])
+				t.Errorf("Result: %#v\n", tx.cmds[i])
+			}
+		}
+	}
+}
+
+var escapeTests = []struct {
+	Kind   string
+	Part   string
+	Expect []string
+}{
+	{
+		"mysql",
+		`a 'b\';c';d;`,
+		[]string{`a 'b\';c';`, "d;"},
+	},
+	{
+		"mysql",
+		`a "b\";c";d 'e\\';f;`,
+		[]string{`a "b\";c";`, `d 'e\\';`, "f;"},
+	},
+	{
+		"mysql",
+		"a 'b'';c';d `e\\`;f;",
+		[]string{"a 'b'';c';", "d `e\\`;", "f;"},
+	},
+	{
+		"postgres",
+		`a E'b\';c';d e'f\\';g;`,
+		[]string{`a E'b\';c';`, `d e'f\\';`, "g;"},
+	},
+	{
+		"postgres",
+		`a E'b''c\';d';e;`,
+		[]string{`a E'b''c\';d';`, "e;"},
+	},
+	{
+		"postgres",
+		`a 'b\';c;`,
+		[]string{`a 'b\';`, "c;"},
+	},
+	{
+		"postgres",
+		`TYPE'b\';c;`,
+		[]string{`TYPE'b\';`, "c;"},
+	},
+	{
+		"sqlite3",
+		"SELECT a$$b; c$$;",
+		[]string{"SELECT a$$b;", " c$$;"},
+	},
+	{
+		"mysql",
+		"SELECT $a$; $a$;",
+		[]string{"SELECT $a$;", " $a$;"},
+	},
+	{
+		"sqlite3",
+		`a 'b\';c "d\";e;`,
+		[]string{`a 'b\';`, `c "d\";`, "e;"},
+	},
+}
+
+func Test_RunMigrationPartEscapes(t *T) {
+	for _, test := range escapeTests {
+		tx := makeFakeTx()
+		err := runMigrationPart(tx, []byte(test.Part), 1, test.Kind)
+		if err != nil {
+			t.Errorf("%s %#v: %v", test.Kind, test.Part, err)
+		}
+		if !reflect.DeepEqual(tx.cmds, test.Expect) {
+			t.Errorf("%s %#v\nExpect: %#v\nResult: %#v", test.Kind, test.Part,
+				test.Expect, tx.cmds)
+		}
+	}
+}
+
+// delimiterTests are split for MySQL, the only kind DELIMITER works with.
+var delimiterTests = []struct {
+	Part   string
+	Expect []string
+}{
+	{
+		"a;\nDELIMITER //\nCREATE PROCEDURE p() BEGIN b; c; END//\n" +
+			"delimiter ;\nd;",
+		[]string{"a;", "CREATE PROCEDURE p() BEGIN b; c; END", "d;"},
+	},
+	{
+		"DELIMITER $$\nCREATE TRIGGER t BEGIN a; '$$'; END$$\nb$$",
+		[]string{"CREATE TRIGGER t BEGIN a; '$$'; END", "\nb"},
+	},
+	{
+		"  Delimiter\t;;\na; b;;\nDELIMITER ;\nc;",
+		[]string{"a; b", "c;"},
+	},
+	{
+		"a;\n-- b\nDELIMITER //\nc//\n//\nd//",
+		[]string{"a;", "c", "\nd"},
+	},
+	{
+		"a\nDELIMITER //\nb;",
+		[]string{"a\nDELIMITER //\nb;"},
+	},
+}
+
+func Test_RunMigrationPartDelimiter(t *T) {
+	for _, test := range delimiterTests {
+		tx := makeFakeTx()
+		err := runMigrationPart(tx, []byte(test.Part), 1, "mysql")
+		if err != nil {
+			t.Errorf("%#v: %v", test.Part, err)
+		}
+		if !reflect.DeepEqual(tx.cmds, test.Expect) {
+			t.Errorf("%#v\nExpect: %#v\nResult: %#v", test.Part, test.Expect,
+				tx.cmds)
+		}
+	}
+}
+
+var partErrorTests = []struct {
+	Part  string
+	Error string
+}{
+	{"a;\n-- dbm:statement-begin\nb;\n", "Line 6: Missing"},
+	{"a;\nb 'c;\nd;", "Line 6: Unterminated quote '"},
+	{"a;\n\nb \"c;", `Line 7: Unterminated quote "`},
+	{"a `b;", "Line 5: Unterminated quote `"},
+	{"a;\n/* b;\n", "Line 6: Unterminated comment"},
+	{"a;\n$f$ b; $$;", "Line 6: Unterminated dollar quote $f$"},
+}
+
+func Test_RunMigrationPartErrors(t *T) {
+	for _, test := range partErrorTests {
+		err := runMigrationPart(makeFakeTx(), []byte(test.Part), 5,
+			"postgres")
+		if err == nil {
+			t.Errorf("%#v: Expected an error", test.Part)
+		} else if !strings.HasPrefix(err.Error(), test.Error) {
+			t.Errorf("%#v: Expected error %q, got: %v", test.Part, test.Error, err)
+		}
+	}
+}
+
+func Test_RunMigrationPartStatementLine(t *T) {
+	fail := errors.New("fail")
+	err := runMigrationPart(failExecer{fail}, []byte("\n-- a\n  b;"), 3,
+		"sqlite3")
+	var stmtErr *StatementError
+	if !errors.As(err, &stmtErr) {
+		t.Fatal("Expected a statement error, got:", err)
+	}
+	if stmtErr.Line != 4 || stmtErr.Stmt != "-- a\n  b;" {
+		t.Errorf("Wrong statement error: %#v", stmtErr)
+	}
+}
+
+type failExecer struct {
+	err error
+}
+
+func (f failExecer) Exec(string, ...interface{}) (sql.Result, error) {
+	return nil, f.err
+}
+
+func Test_GetMigrationPartsDirectives(t *T) {
+	tests := []struct {
+		File string
+		NoTx bool
+		Up   string
+		Down string
+	}{
+		{"a;\n" + Separator + "\nb;\n", false, "a;\n", "b;\n"},
+		{"-- dbm:no-transaction\na;\n", true, "-- dbm:no-transaction\na;\n", ""},
+		{"\n-- hello\n--dbm:no-transaction\na;\n", true,
+			"\n-- hello\n--dbm:no-transaction\na;\n", ""},
+		{"a;\n-- dbm:no-transaction\nb;\n", false,
+			"a;\n-- dbm:no-transaction\nb;\n", ""},
+	}
+
+	for _, test := range tests {
+		source := fstest.MapFS{
+			"1_test.sql": &fstest.MapFile{Data: []byte(test.File)},
+		}
+		up, down, opts, err := getMigrationParts(source, "1_test.sql")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opts.noTransaction != test.NoTx {
+			t.Errorf("%#v: Expect no transaction: %v", test.File, test.NoTx)
+		}
+		if string(up) != test.Up || string(down) != test.Down {
+			t.Errorf("%#v: Wrong up %q or down %q", test.File, up, down)
+		}
+	}
+}
+
+func Test_GetMigrations(t *T) {
+	source := fstest.MapFS{
+		"2_b.sql":        &fstest.MapFile{},
+		"1_a.sql":        &fstest.MapFile{},
+		"README.md":      &fstest.MapFile{},
+		"nested/3_c.sql": &fstest.MapFile{},
+	}
+
+	expect := []string{"1_a.sql", "2_b.sql", "nested/3_c.sql"}
+	files, err := getMigrations(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(expect) {
+		t.Fatalf("Expect: %#v\nResult: %#v", expect, files)
+	}
+	for i := range expect {
+		if files[i] != expect[i] {
+			t.Errorf("Expect: %#v\nResult: %#v", expect, files)
+			break
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package migrator
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// rgxVersion matches the timestamps migrations are versioned with, they must
+// all be the same length since versions are ordered as strings.
+var rgxVersion = regexp.MustCompile(`^[0-9]{14}$`)
+
+// GoFunc is one direction of a migration written in Go. It's given the
+// transaction the migration runs in, which also records it in the tracking
+// table.
+type GoFunc func(tx *sql.Tx) error
+
+// goMigration is a migration registered with Register.
+type goMigration struct {
+	up   GoFunc
+	down GoFunc
+}
+
+// Register adds a migration written in Go for things that are awkward to do
+// in SQL. The version uses the same timestamp format as the migration files
+// (20060102150405) and decides where it runs in relation to them. Down may be
+// nil, in which case the migration can't be rolled back.
+//
+// It shows up as version_name.go in Status and the tracking table.
+func (m *Migrator) Register(version, name string, up, down GoFunc) error {
+	if !rgxVersion.MatchString(version) {
+		return fmt.Errorf("Invalid migration version: %s", version)
+	}
+	if up == nil {
+		return fmt.Errorf("Migration has no up: %s_%s", version, name)
+	}
+
+	for registered := range m.goMigrations {
+		if migFormat(registered) == version {
+			return fmt.Errorf("Migration version registered twice: %s", version)
+		}
+	}
+
+	if m.goMigrations == nil {
+		m.goMigrations = make(map[string]goMigration)
+	}
+	m.goMigrations[version+"_"+name+".go"] = goMigration{up: up, down: down}
+	return nil
+}
+
+// isGo is true if the migration is written in Go rather than being a file,
+// whether it was registered or not.
+func (m *Migrator) isGo(migration string) bool {
+	return path.Ext(migration) == ".go"
+}
+
+// unregisteredGo returns the Go migrations in done that aren't in files, see
+// Migrator.AllowUnregistered.
+func unregisteredGo(files []string, done []TrackedMigration) []string {
+	var unregistered []string
+	for _, mig := range done {
+		if path.Ext(mig.Filename) != ".go" ||
+			checkVersionExists(files, mig.Migration) == nil {
+			continue
+		}
+		unregistered = append(unregistered, mig.Filename)
+	}
+	return unregistered
+}
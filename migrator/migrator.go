@@ -0,0 +1,808 @@
+/*
+Package migrator runs dbm migration files against a database. It's what the
+dbm command uses underneath, and can be used to migrate a database from inside
+another program or its tests.
+
+Unlike the dbm command nothing here exits the program, every problem is
+returned as an error.
+*/
+package migrator
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aarondl/dbm/config"
+	"github.com/aarondl/paths"
+)
+
+const warnModified = `Warning: Migrations were modified after they were run:`
+
+var (
+	// ErrAtomic is returned when Atomic is set but the database commits schema
+	// changes immediately so they can't be rolled back.
+	ErrAtomic = errors.New("Atomic can't be used with this database, " +
+		"schema changes are committed immediately so they can't be rolled back")
+	// ErrLocked is returned when another migrator holds the lock on the
+	// database for longer than LockTimeout. Sqlite3 wraps it with how to
+	// release a lock left behind, check for it with errors.Is.
+	ErrLocked = errors.New("Another dbm is migrating this database, " +
+		"timed out waiting for its lock")
+)
+
+// Migrator runs migration files against a database.
+type Migrator struct {
+	// Source holds the migration files, any file ending in .sql is a
+	// migration. Use os.DirFS for a directory on disk or embed.FS to build
+	// the migrations into the program.
+	Source fs.FS
+	// Log receives the same output the dbm command prints. Nothing is
+	// written if it's nil.
+	Log io.Writer
+	// Verbose also logs each statement and transaction.
+	Verbose bool
+	// AllowDrift logs a warning instead of failing when a migration that has
+	// been run was modified afterwards.
+	AllowDrift bool
+	// OutOfOrder runs any migration that hasn't been run even if it's older
+	// than ones that have, and rolls back in the order migrations were run.
+	OutOfOrder bool
+	// DryRun logs the statements that would be run instead of running them.
+	DryRun bool
+	// Atomic runs all the migrations in a batch in a single transaction.
+	Atomic bool
+	// Events is called after each migration is run or rolled back, whether
+	// it succeeded or not, for programs that want more than Log.
+	Events func(Event)
+	// LockTimeout is how long to wait for another migrator to finish before
+	// giving up with ErrLocked. Migrating and rolling back hold a lock on the
+	// database so that only one can run at once, if it's 0 the lock is only
+	// tried once.
+	LockTimeout time.Duration
+	// AllowUnregistered treats Go migrations in the tracking table that
+	// weren't registered, like those run by another program, as having been
+	// run instead of as missing files. They can't be rolled back.
+	AllowUnregistered bool
+
+	engine       SqlEngine
+	goMigrations map[string]goMigration
+}
+
+// New creates a migrator for the migrations in source using an engine that
+// has already been opened.
+func New(engine SqlEngine, source fs.FS) *Migrator {
+	return &Migrator{
+		Source: source,
+		engine: engine,
+	}
+}
+
+// Open connects to the database in conf and creates a migrator for the
+// migrations in source. Close should be called when done.
+//
+// Sqlite3 databases are found from the VCS root like the dbm command does, or
+// from the working directory when there isn't one, such as when a program is
+// deployed on its own. Use NewEngine and New to choose.
+func Open(conf *config.DB, source fs.FS) (*Migrator, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	_, root, _ := paths.FindVCSRoot(wd)
+
+	engine, err := NewEngine(conf, len(root) != 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = engine.Open(); err != nil {
+		return nil, err
+	}
+	return New(engine, source), nil
+}
+
+// Close the connection to the database.
+func (m *Migrator) Close() error {
+	return m.engine.Close()
+}
+
+// Up runs n migrations, or all of them if n is 0. It returns the number of
+// migrations that were run.
+func (m *Migrator) Up(n int) (int, error) {
+	return m.up(n, "")
+}
+
+// UpTo runs every migration up to and including version.
+func (m *Migrator) UpTo(version string) (int, error) {
+	return m.up(0, version)
+}
+
+// Down rolls back n migrations, or 1 if n is 0. It returns the number of
+// migrations that were rolled back.
+func (m *Migrator) Down(n int) (int, error) {
+	return m.down(n, "")
+}
+
+// DownTo rolls back every migration newer than version.
+func (m *Migrator) DownTo(version string) (int, error) {
+	return m.down(0, version)
+}
+
+// To migrates the database to version, rolling back every migration newer
+// than it and running every migration up to and including it.
+func (m *Migrator) To(version string) (int, error) {
+	down, err := m.DownTo(version)
+	if err != nil {
+		return down, err
+	}
+	up, err := m.UpTo(version)
+	return down + up, err
+}
+
+func (m *Migrator) up(step int, to string) (int, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	files, done, err := m.load(!m.DryRun)
+	if err != nil {
+		return 0, err
+	}
+
+	toMigrate, err := m.toMigrate(files, done, step, to)
+	if err != nil || len(toMigrate) == 0 {
+		return 0, err
+	}
+
+	m.logln("Running", len(toMigrate), "migrations...")
+	return m.run(toMigrate, false)
+}
+
+func (m *Migrator) down(step int, to string) (int, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	files, done, err := m.load(!m.DryRun)
+	if err != nil {
+		return 0, err
+	}
+
+	toRollback, err := m.toRollback(files, done, step, to)
+	if err != nil || len(toRollback) == 0 {
+		return 0, err
+	}
+
+	m.logln("Rolling back", len(toRollback), "migrations...")
+	return m.run(toRollback, true)
+}
+
+// lock takes the engine's lock until the returned func is called. Dry runs
+// don't change anything so they don't need it.
+func (m *Migrator) lock() (func(), error) {
+	if m.DryRun {
+		return func() {}, nil
+	}
+
+	if err := m.engine.Lock(m.LockTimeout); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := m.engine.Unlock(); err != nil {
+			m.logln("Warning: Could not release lock:", err)
+		}
+	}, nil
+}
+
+// load gets the migrations and the migrations that have been run. Unless
+// upgrade is true the database is left untouched, even if the tracking table
+// is from an older version.
+func (m *Migrator) load(upgrade bool) ([]string, []TrackedMigration, error) {
+	files, err := m.migrations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if upgrade {
+		if err = upgradeTrackTable(m.engine); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	done, err := getRunMigrations(m.engine)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.AllowUnregistered {
+		files = append(files, unregisteredGo(files, done)...)
+		sort.Sort(migrationsByVersion(files))
+	}
+	return files, done, nil
+}
+
+// migrations returns the migration files along with the Go migrations, in
+// version order.
+func (m *Migrator) migrations() ([]string, error) {
+	files := make([]string, 0, len(m.goMigrations))
+	if m.Source != nil {
+		var err error
+		if files, err = getMigrations(m.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range m.goMigrations {
+		for _, f := range files {
+			if migFormat(f) == migFormat(name) {
+				return nil, fmt.Errorf(
+					"Go migration %s has the same version as %s", name, f)
+			}
+		}
+		files = append(files, name)
+	}
+
+	sort.Sort(migrationsByVersion(files))
+	return files, nil
+}
+
+type migrationsByVersion []string
+
+func (m migrationsByVersion) Len() int      { return len(m) }
+func (m migrationsByVersion) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m migrationsByVersion) Less(i, j int) bool {
+	if vi, vj := migFormat(m[i]), migFormat(m[j]); vi != vj {
+		return vi < vj
+	}
+	return m[i] < m[j]
+}
+
+// toMigrate returns the files that should be run, in the order they should be
+// run. A step of 0 means all of them.
+func (m *Migrator) toMigrate(files []string, done []TrackedMigration,
+	step int, to string) ([]string, error) {
+
+	if err := m.check(files, done); err != nil {
+		return nil, err
+	}
+	pending := getPending(files, done)
+
+	if len(to) != 0 {
+		if err := checkVersionExists(files, to); err != nil {
+			return nil, err
+		}
+		pending = filterVersions(pending, func(v string) bool { return v <= to })
+	}
+
+	if step == 0 || step > len(pending) {
+		step = len(pending)
+	}
+	return pending[:step], nil
+}
+
+// toRollback returns the files that should be undone, in the order they
+// should be undone. A step of 0 means 1.
+func (m *Migrator) toRollback(files []string, done []TrackedMigration,
+	step int, to string) ([]string, error) {
+
+	if err := m.check(files, done); err != nil {
+		return nil, err
+	}
+	var applied []string
+	if m.OutOfOrder {
+		var err error
+		if applied, err = getApplied(files, done); err != nil {
+			return nil, err
+		}
+	} else {
+		applied = filterVersions(files, appliedVersions(done))
+	}
+
+	if len(to) != 0 {
+		if err := checkVersionExists(files, to); err != nil {
+			return nil, err
+		}
+		applied = filterVersions(applied, func(v string) bool { return v > to })
+	} else {
+		if step == 0 {
+			step = 1
+		}
+		if step > len(applied) {
+			step = len(applied)
+		}
+		applied = applied[len(applied)-step:]
+	}
+
+	toRollback := make([]string, len(applied))
+	for i, f := range applied {
+		toRollback[len(applied)-1-i] = f
+	}
+	return toRollback, nil
+}
+
+// run runs each migration in its own transaction, or when Atomic is set, all
+// of them in a single transaction. It returns how many were run successfully.
+func (m *Migrator) run(migrations []string, rollback bool) (int, error) {
+	if !m.Atomic || m.DryRun {
+		for i, migration := range migrations {
+			if err := m.migrate(migration, rollback); err != nil {
+				return i, err
+			}
+		}
+		return len(migrations), nil
+	}
+
+	if !m.engine.TransactionalDDL() {
+		return 0, ErrAtomic
+	}
+
+	tx, err := m.beginTx()
+	if err != nil {
+		return 0, err
+	}
+	// Events are held until the transaction ends so nothing is reported as
+	// done before it's committed.
+	var events []Event
+	for _, migration := range migrations {
+		if err = m.migrateTx(tx, migration, rollback, &events); err != nil {
+			err = m.endTx(tx, err)
+			m.flushEvents(events, err)
+			return 0, err
+		}
+	}
+	err = m.endTx(tx, nil)
+	m.flushEvents(events, err)
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+func (m *Migrator) migrate(migration string, rollback bool) (err error) {
+	start := time.Now()
+	l, err := m.loadMigration(migration, rollback)
+	defer func() { m.event(migration, rollback, l, start, err) }()
+	if err != nil {
+		return err
+	}
+
+	if m.DryRun {
+		if l.fn != nil {
+			m.logln("-- Go migration")
+			return nil
+		}
+		exec := printExecer{m.logWriter(), m.engine.Kind()}
+		return runMigrationPart(recordExecer{exec, l.stmts}, l.part, l.line,
+			m.engine.Kind())
+	}
+
+	if l.opts.noTransaction {
+		if m.Verbose {
+			m.logln("Running without transaction")
+		}
+		if err = runMigrationPart(m.execer(m.engine, l), l.part, l.line,
+			m.engine.Kind()); err != nil {
+			return err
+		}
+		tx, err := m.beginTx()
+		if err != nil {
+			return err
+		}
+		return m.endTx(tx, m.trackMigration(tx, l, start))
+	}
+
+	tx, err := m.beginTx()
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	err = m.runPart(tx, l)
+	if err == nil {
+		err = m.trackMigration(tx, l, start)
+	}
+	return m.endTx(tx, err)
+}
+
+// migrateTx runs a migration and updates the tracking table inside tx.
+func (m *Migrator) migrateTx(tx *sql.Tx, migration string,
+	rollback bool, events *[]Event) (err error) {
+
+	start := time.Now()
+	l, err := m.loadMigration(migration, rollback)
+	defer func() {
+		*events = append(*events, newEvent(migration, rollback, l, start, err))
+	}()
+	if err != nil {
+		return err
+	}
+	if l.opts.noTransaction {
+		return fmt.Errorf("Migration can't run in a transaction (%s): %s",
+			directiveNoTx, path.Base(migration))
+	}
+
+	if err = m.runPart(tx, l); err != nil {
+		return err
+	}
+	return m.trackMigration(tx, l, start)
+}
+
+// runPart runs the section of the migration chosen by loadMigration.
+func (m *Migrator) runPart(tx *sql.Tx, l loadedMigration) error {
+	if l.fn != nil {
+		if err := l.fn(tx); err != nil {
+			return fmt.Errorf("Running migration\t[FAIL]\nErr: %v\n", err)
+		}
+		return nil
+	}
+	return runMigrationPart(m.execer(tx, l), l.part, l.line, m.engine.Kind())
+}
+
+// loadedMigration is a migration ready to be run.
+type loadedMigration struct {
+	file     string
+	rollback bool
+	// up is the up section, needed for its checksum even when rolling back.
+	up []byte
+	// part is the section to run.
+	part []byte
+	// line is the line of the file part starts on.
+	line int
+	// fn is the function to run instead of part for Go migrations.
+	fn   GoFunc
+	opts migrationOptions
+	// stmts are the statements that have been run.
+	stmts *[]string
+}
+
+// loadMigration reads a migration and picks the section that should be run.
+func (m *Migrator) loadMigration(migration string,
+	rollback bool) (loadedMigration, error) {
+
+	shortname := path.Base(migration)
+	if m.Verbose {
+		m.logln("=====================================")
+		m.logln(shortname)
+		m.logln("=====================================")
+	} else {
+		m.logln(shortname)
+	}
+
+	if goMig, ok := m.goMigrations[migration]; ok {
+		l := loadedMigration{
+			file:     migration,
+			rollback: rollback,
+			fn:       goMig.up,
+			stmts:    new([]string),
+		}
+		if rollback {
+			if goMig.down == nil {
+				return l, fmt.Errorf(
+					"Tried to rollback migration without down: %s", shortname)
+			}
+			l.fn = goMig.down
+		}
+		return l, nil
+	} else if m.isGo(migration) {
+		return loadedMigration{}, fmt.Errorf(
+			"Go migration isn't registered: %s", shortname)
+	}
+
+	up, down, opts, err := getMigrationParts(m.Source, migration)
+	if err != nil {
+		return loadedMigration{}, err
+	}
+
+	l := loadedMigration{
+		file:     migration,
+		rollback: rollback,
+		up:       up,
+		part:     up,
+		line:     1,
+		opts:     opts,
+		stmts:    new([]string),
+	}
+	if rollback {
+		if len(down) == 0 {
+			return l, fmt.Errorf(
+				"Tried to rollback migration without down: %s", shortname)
+		}
+		l.part = down
+		l.line = downLine(up)
+	}
+	return l, nil
+}
+
+// trackMigration adds or removes the migration's record in the tracking table.
+func (m *Migrator) trackMigration(tx *sql.Tx, l loadedMigration,
+	start time.Time) error {
+
+	if l.rollback {
+		return m.engine.DeleteMigration(tx, migFormat(l.file))
+	}
+
+	mig := TrackedMigration{
+		Migration: migFormat(l.file),
+		Filename:  path.Base(l.file),
+		AppliedAt: start,
+		Duration:  time.Since(start),
+	}
+	// There's nothing to compare a checksum of a Go migration to.
+	if l.fn == nil {
+		mig.Checksum = checksum(l.up)
+	}
+	return m.engine.AddMigration(tx, mig)
+}
+
+func (m *Migrator) beginTx() (*sql.Tx, error) {
+	tx, err := m.engine.Begin()
+	if err != nil {
+		m.logln("Beginning transaction\t[FAIL]")
+		return nil, fmt.Errorf("Failed to begin transaction: %v", err)
+	} else if m.Verbose {
+		m.logln("Beginning transaction\t[SUCCESS]")
+	}
+	return tx, nil
+}
+
+// endTx commits the transaction, or if txErr is not nil rolls it back and
+// returns txErr.
+func (m *Migrator) endTx(tx *sql.Tx, txErr error) error {
+	if txErr != nil {
+		if err := tx.Rollback(); err != nil {
+			m.logln("Rollback transaction\t[FAIL]")
+			m.logln("Failed to roll back:", err)
+		} else {
+			m.logln("Rollback transaction\t[SUCCESS]")
+		}
+		return txErr
+	}
+
+	if err := tx.Commit(); err != nil {
+		m.logln("Commit transaction\t[FAIL]")
+		return fmt.Errorf("Failed to commit: %v", err)
+	} else if m.Verbose {
+		m.logln("Commit transaction\t[SUCCESS]")
+	}
+	return nil
+}
+
+// check makes sure the migrations can be run or rolled back. Out of order
+// only the tracking table and modifications are checked, otherwise the
+// migrations must also be in sync.
+func (m *Migrator) check(files []string, done []TrackedMigration) error {
+	if !m.OutOfOrder {
+		return m.checkInSync(files, done)
+	}
+	if dups := duplicateVersions(done); len(dups) != 0 {
+		return SyncError{Duplicates: dups}
+	}
+	return m.checkUnmodified(files, done)
+}
+
+// checkInSync checks that the run migrations are exactly the oldest migration
+// files, each run once, and that none of them were modified.
+func (m *Migrator) checkInSync(files []string, done []TrackedMigration) error {
+	syncErr := SyncError{Duplicates: duplicateVersions(done)}
+	for _, s := range getStatuses(files, done) {
+		switch s.State {
+		case StateGap:
+			syncErr.Gaps = append(syncErr.Gaps, s.Name)
+		case StateOrphan:
+			syncErr.Orphans = append(syncErr.Orphans, s.Version)
+		}
+	}
+
+	if len(syncErr.Gaps) != 0 || len(syncErr.Orphans) != 0 ||
+		len(syncErr.Duplicates) != 0 {
+		return syncErr
+	}
+
+	return m.checkUnmodified(files, done)
+}
+
+// checkUnmodified compares the up section of every applied migration against
+// the checksum recorded when it was run. Migrations run before checksums were
+// recorded are not checked.
+func (m *Migrator) checkUnmodified(files []string,
+	done []TrackedMigration) error {
+
+	byVersion := make(map[string]string, len(files))
+	for _, f := range files {
+		byVersion[migFormat(f)] = f
+	}
+
+	var modified ModifiedError
+	for _, mig := range done {
+		file, ok := byVersion[mig.Migration]
+		if !ok || len(mig.Checksum) == 0 || m.isGo(file) {
+			continue
+		}
+
+		up, _, _, err := getMigrationParts(m.Source, file)
+		if err != nil {
+			return err
+		}
+		if checksum(up) != mig.Checksum {
+			modified = append(modified, path.Base(file))
+		}
+	}
+
+	if len(modified) == 0 {
+		return nil
+	}
+	if !m.AllowDrift {
+		return modified
+	}
+
+	m.logln(warnModified)
+	for _, mig := range modified {
+		m.logf("    %s\n", mig)
+	}
+	return nil
+}
+
+// SyncError is returned when the migrations that have been run are not
+// exactly the oldest migration files.
+type SyncError struct {
+	// Gaps are the migration files that have not been run but are older than
+	// ones that have.
+	Gaps []string
+	// Orphans are the versions of migrations that have been run but have no
+	// migration file.
+	Orphans []string
+	// Duplicates are the versions of migrations that are in the tracking
+	// table more than once.
+	Duplicates []string
+}
+
+func (s SyncError) Error() string {
+	msg := "Migrations are out of sync"
+	for _, gap := range s.Gaps {
+		msg += "\n    Migration file created after later migrations were run: " +
+			gap
+	}
+	for _, orphan := range s.Orphans {
+		msg += fmt.Sprintf("\n    Migration file starting with %q missing",
+			orphan)
+	}
+	for _, dup := range s.Duplicates {
+		msg += fmt.Sprintf("\n    Migration %q was tracked more than once", dup)
+	}
+	if len(s.Gaps) != 0 {
+		msg += "\nRun out of order to run the migrations that were skipped."
+	}
+	return msg
+}
+
+// ModifiedError is returned when migrations were modified after they were
+// run. It holds the names of the migration files.
+type ModifiedError []string
+
+func (m ModifiedError) Error() string {
+	msg := "Migrations were modified after they were run"
+	for _, mig := range m {
+		msg += "\n    " + mig
+	}
+	return msg
+}
+
+func checkVersionExists(files []string, version string) error {
+	for _, f := range files {
+		if migFormat(f) == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("No migration file with version %q", version)
+}
+
+// filterVersions returns the files whose versions satisfy keep.
+func filterVersions(files []string, keep func(string) bool) []string {
+	filtered := make([]string, 0, len(files))
+	for _, f := range files {
+		if keep(migFormat(f)) {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+// appliedVersions returns a filter for filterVersions that keeps the versions
+// that have been run.
+func appliedVersions(done []TrackedMigration) func(string) bool {
+	applied := make(map[string]bool, len(done))
+	for _, mig := range done {
+		applied[mig.Migration] = true
+	}
+	return func(v string) bool { return applied[v] }
+}
+
+// duplicateVersions returns the versions that are tracked more than once.
+func duplicateVersions(done []TrackedMigration) []string {
+	seen := make(map[string]int, len(done))
+	var dups []string
+	for _, mig := range done {
+		seen[mig.Migration]++
+		if seen[mig.Migration] == 2 {
+			dups = append(dups, mig.Migration)
+		}
+	}
+	return dups
+}
+
+// getPending returns the files that have not been run regardless of where
+// they fall in relation to the ones that have.
+func getPending(files []string, done []TrackedMigration) []string {
+	applied := make(map[string]bool, len(done))
+	for _, mig := range done {
+		applied[mig.Migration] = true
+	}
+
+	pending := make([]string, 0)
+	for _, f := range files {
+		if !applied[migFormat(f)] {
+			pending = append(pending, f)
+		}
+	}
+	return pending
+}
+
+// getApplied returns the files of the run migrations in the order that they
+// were run. Migrations run before the time was recorded come first.
+func getApplied(files []string, done []TrackedMigration) ([]string, error) {
+	byVersion := make(map[string]string, len(files))
+	for _, f := range files {
+		byVersion[migFormat(f)] = f
+	}
+
+	ordered := make([]TrackedMigration, len(done))
+	copy(ordered, done)
+	sort.Stable(byApplied(ordered))
+
+	applied := make([]string, len(ordered))
+	for i, mig := range ordered {
+		file, ok := byVersion[mig.Migration]
+		if !ok {
+			return nil, fmt.Errorf(
+				"Migration file starting with %q missing", mig.Migration)
+		}
+		applied[i] = file
+	}
+	return applied, nil
+}
+
+type byApplied []TrackedMigration
+
+func (b byApplied) Len() int      { return len(b) }
+func (b byApplied) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byApplied) Less(i, j int) bool {
+	if !b[i].AppliedAt.Equal(b[j].AppliedAt) {
+		return b[i].AppliedAt.Before(b[j].AppliedAt)
+	}
+	return b[i].Migration < b[j].Migration
+}
+
+func (m *Migrator) logWriter() io.Writer {
+	if m.Log == nil {
+		return ioutil.Discard
+	}
+	return m.Log
+}
+
+func (m *Migrator) logln(args ...interface{}) {
+	fmt.Fprintln(m.logWriter(), args...)
+}
+
+func (m *Migrator) logf(format string, args ...interface{}) {
+	fmt.Fprintf(m.logWriter(), format, args...)
+}
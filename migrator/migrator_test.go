@@ -0,0 +1,292 @@
+package migrator
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	. "testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/aarondl/dbm/config"
+)
+
+func Test_GetPendingApplied(t *T) {
+	files := []string{"1_a.sql", "2_b.sql", "3_c.sql", "4_d.sql"}
+	done := []TrackedMigration{
+		{Migration: "1", AppliedAt: time.Unix(10, 0)},
+		{Migration: "4", AppliedAt: time.Unix(20, 0)},
+		{Migration: "2", AppliedAt: time.Unix(30, 0)},
+	}
+
+	pending := getPending(files, done)
+	if len(pending) != 1 || pending[0] != "3_c.sql" {
+		t.Error("Wrong pending migrations:", pending)
+	}
+
+	expect := []string{"1_a.sql", "4_d.sql", "2_b.sql"}
+	applied, err := getApplied(files, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(expect) {
+		t.Fatalf("Expect: %#v\nResult: %#v", expect, applied)
+	}
+	for i := range expect {
+		if applied[i] != expect[i] {
+			t.Errorf("Expect: %#v\nResult: %#v", expect, applied)
+			break
+		}
+	}
+}
+
+var toTests = []struct {
+	Rollback   bool
+	OutOfOrder bool
+	Done       []string
+	Step       int
+	To         string
+	Expect     []string
+	Err        bool
+}{
+	{false, false, []string{"1", "2"}, 0, "4", []string{"3_c.sql", "4_d.sql"}, false},
+	{false, false, []string{"1", "2"}, 1, "4", []string{"3_c.sql"}, false},
+	{false, false, []string{"1", "2"}, 0, "2", []string{}, false},
+	{false, false, []string{"1", "2"}, 0, "9", nil, true},
+	{false, true, []string{"1", "4", "2"}, 0, "4", []string{"3_c.sql"}, false},
+	{false, true, []string{"1", "4", "2"}, 0, "5", []string{"3_c.sql", "5_e.sql"}, false},
+	{false, true, []string{"1", "4", "2"}, 0, "9", nil, true},
+	{true, false, []string{"1", "2", "3"}, 0, "1", []string{"3_c.sql", "2_b.sql"}, false},
+	{true, false, []string{"1", "2", "3"}, 0, "3", []string{}, false},
+	{true, false, []string{"1", "2", "3"}, 0, "9", nil, true},
+	{true, true, []string{"1", "4", "2"}, 0, "1", []string{"2_b.sql", "4_d.sql"}, false},
+	{true, true, []string{"1", "4", "2"}, 0, "2", []string{"4_d.sql"}, false},
+	{true, true, []string{"1", "4", "2"}, 0, "9", nil, true},
+}
+
+func Test_ToVersion(t *T) {
+	files := []string{"1_a.sql", "2_b.sql", "3_c.sql", "4_d.sql", "5_e.sql"}
+	for i, test := range toTests {
+		done := make([]TrackedMigration, len(test.Done))
+		for j, v := range test.Done {
+			done[j] = TrackedMigration{Migration: v, AppliedAt: time.Unix(int64(j), 0)}
+		}
+		m := New(nil, fstest.MapFS{})
+		m.OutOfOrder = test.OutOfOrder
+
+		var result []string
+		var err error
+		if test.Rollback {
+			result, err = m.toRollback(files, done, test.Step, test.To)
+		} else {
+			result, err = m.toMigrate(files, done, test.Step, test.To)
+		}
+
+		if test.Err {
+			if err == nil {
+				t.Errorf("%d) Expected an error for unknown version %q", i, test.To)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d) Unexpected error: %v", i, err)
+			continue
+		}
+		if len(result) != len(test.Expect) {
+			t.Errorf("%d) Expect: %#v\nResult: %#v", i, test.Expect, result)
+			continue
+		}
+		for j := range test.Expect {
+			if result[j] != test.Expect[j] {
+				t.Errorf("%d) Expect: %#v\nResult: %#v", i, test.Expect, result)
+				break
+			}
+		}
+	}
+}
+
+func Test_GoMigrations(t *T) {
+	m := New(nil, fstest.MapFS{
+		"20200101000001_a.sql": &fstest.MapFile{},
+		"20200101000003_c.sql": &fstest.MapFile{},
+	})
+
+	noop := func(*sql.Tx) error { return nil }
+	if err := m.Register("20200101000002", "b", noop, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register("20200101000002", "again", noop, nil); err == nil {
+		t.Error("Expected an error registering the same version twice")
+	}
+	for _, bad := range []string{"x", "5", "202001010000021"} {
+		if err := m.Register(bad, "bad", noop, nil); err == nil {
+			t.Errorf("Expected an error for bad version %q", bad)
+		}
+	}
+
+	expect := []string{
+		"20200101000001_a.sql", "20200101000002_b.go", "20200101000003_c.sql",
+	}
+	migrations, err := m.migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != len(expect) {
+		t.Fatalf("Expect: %#v\nResult: %#v", expect, migrations)
+	}
+	for i := range expect {
+		if migrations[i] != expect[i] {
+			t.Errorf("Expect: %#v\nResult: %#v", expect, migrations)
+			break
+		}
+	}
+
+	if err := m.Register("20200101000003", "c", noop, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.migrations(); err == nil {
+		t.Error("Expected an error for a Go migration with a file's version")
+	}
+}
+
+var duplicateTests = []struct {
+	Done       []string
+	OutOfOrder bool
+}{
+	{[]string{"1", "1", "2"}, false},
+	{[]string{"1", "1", "2", "3"}, false},
+	{[]string{"1", "2", "2"}, true},
+}
+
+func Test_DuplicateTracked(t *T) {
+	files := []string{"1_a.sql", "2_b.sql", "3_c.sql"}
+	for _, test := range duplicateTests {
+		done := make([]TrackedMigration, len(test.Done))
+		for i, v := range test.Done {
+			done[i] = TrackedMigration{Migration: v}
+		}
+		m := New(nil, fstest.MapFS{})
+		m.OutOfOrder = test.OutOfOrder
+
+		_, err := m.toMigrate(files, done, 0, "")
+		if syncErr, ok := err.(SyncError); !ok || len(syncErr.Duplicates) != 1 {
+			t.Errorf("%v: Expected duplicates from toMigrate, got: %v", test.Done, err)
+		}
+		_, err = m.toRollback(files, done, 0, "")
+		if syncErr, ok := err.(SyncError); !ok || len(syncErr.Duplicates) != 1 {
+			t.Errorf("%v: Expected duplicates from toRollback, got: %v", test.Done, err)
+		}
+	}
+}
+
+var unmodifiedTests = []struct {
+	Migration  string
+	Checksum   string
+	AllowDrift bool
+	Modified   bool
+}{
+	{"1", "current", false, false},
+	{"1", "stale", false, true},
+	{"1", "", false, false},
+	{"2", "stale", false, false},
+	{"1", "stale", true, false},
+}
+
+func Test_CheckUnmodified(t *T) {
+	source := fstest.MapFS{
+		"1_a.sql": &fstest.MapFile{
+			Data: []byte("CREATE TABLE a (id int);\n" + Separator + "\nDROP TABLE a;\n"),
+		},
+	}
+	up, _, _, err := getMigrationParts(source, "1_a.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := checksum(up)
+
+	files := []string{"1_a.sql", "2_b.go"}
+	for i, test := range unmodifiedTests {
+		var log bytes.Buffer
+		m := New(nil, source)
+		m.Log = &log
+		m.AllowDrift = test.AllowDrift
+
+		sum := test.Checksum
+		if sum == "current" {
+			sum = current
+		}
+		done := []TrackedMigration{{Migration: test.Migration, Checksum: sum}}
+
+		err := m.checkUnmodified(files, done)
+		if modified, ok := err.(ModifiedError); test.Modified {
+			if !ok || len(modified) != 1 || modified[0] != "1_a.sql" {
+				t.Errorf("%d) Expected 1_a.sql to be modified, got: %v", i, err)
+			}
+		} else if err != nil {
+			t.Errorf("%d) Unexpected error: %v", i, err)
+		}
+
+		warned := strings.Contains(log.String(), warnModified)
+		if expect := test.AllowDrift; warned != expect {
+			t.Errorf("%d) Expected warning %t, log: %q", i, expect, log.String())
+		}
+	}
+}
+
+func Test_NewEngineResolvesPass(t *T) {
+	conf := &config.DB{
+		Name:     "dev",
+		Kind:     "postgres",
+		PassFile: filepath.Join(t.TempDir(), "missing"),
+	}
+	if _, err := NewEngine(conf, false); err == nil {
+		t.Error("Expected an error for a missing pass_file")
+	}
+}
+
+func Test_FlushEvents(t *T) {
+	var got []Event
+	m := New(nil, fstest.MapFS{})
+	m.Events = func(e Event) { got = append(got, e) }
+
+	stmtErr := &StatementError{Stmt: "bad", Line: 1, Err: sql.ErrNoRows}
+	events := []Event{{Migration: "1_a.sql"}, {Migration: "2_b.sql", Err: stmtErr}}
+
+	m.flushEvents(events, stmtErr)
+	if len(got) != 2 {
+		t.Fatal("Expected 2 events, got:", len(got))
+	}
+	if got[0].Err == nil {
+		t.Error("Expected the rolled back migration to report an error")
+	}
+	if got[1].Err != stmtErr {
+		t.Error("Expected the failed migration to keep its error, got:", got[1].Err)
+	}
+
+	got = nil
+	m.flushEvents(events[:1], nil)
+	if len(got) != 1 || got[0].Err != nil {
+		t.Error("Expected a committed migration to succeed, got:", got)
+	}
+}
+
+func Test_UnregisteredGo(t *T) {
+	files := []string{"1_a.sql", "2_b.go"}
+	done := []TrackedMigration{
+		{Migration: "1", Filename: "1_a.sql"},
+		{Migration: "2", Filename: "2_b.go"},
+		{Migration: "3", Filename: "3_c.go"},
+		{Migration: "4"},
+	}
+
+	unregistered := unregisteredGo(files, done)
+	if len(unregistered) != 1 || unregistered[0] != "3_c.go" {
+		t.Error("Wrong unregistered migrations:", unregistered)
+	}
+
+	m := New(nil, fstest.MapFS{})
+	if _, err := m.loadMigration("3_c.go", false); err == nil {
+		t.Error("Expected an error loading an unregistered Go migration")
+	}
+}
@@ -0,0 +1,126 @@
+package migrator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+)
+
+const scriptHeader = `-- Generated by dbm.
+-- Each migration runs in its own transaction and records itself in %s.
+`
+
+// ScriptOptions chooses the migrations Script writes.
+type ScriptOptions struct {
+	// Down writes the rollback instead of the migration.
+	Down bool
+	// Step is the number of migrations, see Up and Down.
+	Step int
+	// To is the version to stop at, see UpTo and DownTo.
+	To string
+	// Since is the newest version that has been run. When it's set the
+	// database is not asked which migrations have been run, so the engine
+	// doesn't need to be opened.
+	Since string
+}
+
+// Script writes the migrations that would be run (or rolled back) to w
+// instead of running them, so they can be applied by hand. The statements are
+// split the same way they are when run and are followed by the statement that
+// updates the tracking table. It returns the number of migrations written.
+func (m *Migrator) Script(w io.Writer, opts ScriptOptions) (int, error) {
+	var files []string
+	var done []TrackedMigration
+	var err error
+	if len(opts.Since) != 0 {
+		if files, err = m.migrations(); err != nil {
+			return 0, err
+		}
+		if err = checkVersionExists(files, opts.Since); err != nil {
+			return 0, err
+		}
+		for _, f := range filterVersions(files, func(v string) bool {
+			return v <= opts.Since
+		}) {
+			done = append(done, TrackedMigration{Migration: migFormat(f)})
+		}
+	} else if files, done, err = m.load(false); err != nil {
+		return 0, err
+	}
+
+	var migrations []string
+	if opts.Down {
+		migrations, err = m.toRollback(files, done, opts.Step, opts.To)
+	} else {
+		migrations, err = m.toMigrate(files, done, opts.Step, opts.To)
+	}
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, scriptHeader, m.engine.TrackTable())
+	for _, migration := range migrations {
+		if err = m.scriptMigration(bw, migration, opts.Down); err != nil {
+			return 0, err
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(migrations), nil
+}
+
+// scriptMigration writes a single migration split into the statements that
+// would be executed, followed by the change to the tracking table.
+func (m *Migrator) scriptMigration(w io.Writer, migration string,
+	rollback bool) error {
+
+	shortname := path.Base(migration)
+	if m.isGo(migration) {
+		return fmt.Errorf("Go migrations can't be written to a script: %s",
+			shortname)
+	}
+
+	up, down, opts, err := getMigrationParts(m.Source, migration)
+	if err != nil {
+		return err
+	}
+	if rollback && len(down) == 0 {
+		return fmt.Errorf("Tried to rollback migration without down: %s",
+			shortname)
+	}
+
+	fmt.Fprintf(w, "\n-- %s\n", shortname)
+	if opts.noTransaction {
+		fmt.Fprintf(w, "-- %s\n", directiveNoTx)
+	} else {
+		fmt.Fprintln(w, m.engine.ScriptBegin())
+	}
+
+	exec := printExecer{w, m.engine.Kind()}
+	if rollback {
+		if err := runMigrationPart(exec, down, downLine(up),
+			m.engine.Kind()); err != nil {
+			return fmt.Errorf("%s: %w", shortname, err)
+		}
+		fmt.Fprintln(w, m.engine.ScriptDeleteMigration(migFormat(migration)))
+	} else {
+		if err := runMigrationPart(exec, up, 1, m.engine.Kind()); err != nil {
+			return fmt.Errorf("%s: %w", shortname, err)
+		}
+		fmt.Fprintln(w, m.engine.ScriptAddMigration(TrackedMigration{
+			Migration: migFormat(migration),
+			Filename:  shortname,
+			Checksum:  checksum(up),
+		}))
+	}
+
+	if opts.noTransaction {
+		return nil
+	}
+	_, err = fmt.Fprintln(w, sqlCommit)
+	return err
+}
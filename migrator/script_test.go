@@ -0,0 +1,108 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	. "testing"
+	"testing/fstest"
+)
+
+// scriptEngine has just enough of an engine to write scripts.
+type scriptEngine struct {
+	SqlEngine
+	kind string
+}
+
+func (s scriptEngine) Kind() string        { return s.kind }
+func (s scriptEngine) TrackTable() string  { return "tracked" }
+func (s scriptEngine) ScriptBegin() string { return "BEGIN;" }
+func (s scriptEngine) ScriptDeleteMigration(mig string) string {
+	return "DELETE " + mig + ";"
+}
+func (s scriptEngine) ScriptAddMigration(mig TrackedMigration) string {
+	return "ADD " + mig.Migration + ";"
+}
+
+var scriptTests = []struct {
+	Kind   string
+	Down   bool
+	File   string
+	Expect string
+}{
+	{
+		"sqlite3", false,
+		"INSERT INTO b VALUES (1)\n" + Separator + "\nDELETE FROM b -- all\n",
+		"BEGIN;\nINSERT INTO b VALUES (1);\nADD 2;\nCOMMIT;\n",
+	},
+	{
+		"sqlite3", true,
+		"INSERT INTO b VALUES (1)\n" + Separator + "\nDELETE FROM b -- all\n",
+		"BEGIN;\nDELETE FROM b -- all\n;\nDELETE 2;\nCOMMIT;\n",
+	},
+	{
+		"mysql", false,
+		"DELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END//\n" +
+			"DELIMITER ;\na;\n" + Separator + "\n",
+		"BEGIN;\nDELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END//\n" +
+			"DELIMITER ;\na;\nADD 2;\nCOMMIT;\n",
+	},
+	{
+		"mysql", false,
+		"DELIMITER $$\nCREATE TRIGGER t BEGIN SET @a = '//'; END$$\n" +
+			Separator + "\n",
+		"BEGIN;\nDELIMITER ///\nCREATE TRIGGER t BEGIN SET @a = '//'; END///\n" +
+			"DELIMITER ;\nADD 2;\nCOMMIT;\n",
+	},
+	{
+		"postgres", false,
+		"-- dbm:statement-begin\nCREATE RULE r AS ON DELETE TO t DO INSTEAD (\n" +
+			"  a;\n  b;\n)\n-- dbm:statement-end\n" + Separator + "\n",
+		"BEGIN;\n-- dbm:statement-begin\nCREATE RULE r AS ON DELETE TO t DO INSTEAD (\n" +
+			"  a;\n  b;\n);\n-- dbm:statement-end\nADD 2;\nCOMMIT;\n",
+	},
+	{
+		"mysql", false,
+		"-- dbm:statement-begin\nCREATE TRIGGER t BEGIN a; END\n" +
+			"-- dbm:statement-end\n" + Separator + "\n",
+		"BEGIN;\nDELIMITER //\nCREATE TRIGGER t BEGIN a; END//\n" +
+			"DELIMITER ;\nADD 2;\nCOMMIT;\n",
+	},
+	{
+		"postgres", false,
+		"-- dbm:no-transaction\nCREATE INDEX CONCURRENTLY i ON t (a);\n" +
+			Separator + "\nDROP INDEX i;\n",
+		"-- dbm:no-transaction\n-- dbm:no-transaction\n" +
+			"CREATE INDEX CONCURRENTLY i ON t (a);\nADD 2;\n",
+	},
+	{
+		"postgres", true,
+		"-- dbm:no-transaction\nCREATE INDEX CONCURRENTLY i ON t (a);\n" +
+			Separator + "\nDROP INDEX i;\n",
+		"-- dbm:no-transaction\nDROP INDEX i;\nDELETE 2;\n",
+	},
+}
+
+func Test_Script(t *T) {
+	for i, test := range scriptTests {
+		m := New(scriptEngine{kind: test.Kind}, fstest.MapFS{
+			"1_a.sql": &fstest.MapFile{Data: []byte("a;\n" + Separator + "\n")},
+			"2_b.sql": &fstest.MapFile{Data: []byte(test.File)},
+		})
+
+		opts := ScriptOptions{Down: test.Down, Since: "1"}
+		if test.Down {
+			opts.Since = "2"
+		}
+		var b bytes.Buffer
+		if _, err := m.Script(&b, opts); err != nil {
+			t.Errorf("%d) %v", i, err)
+			continue
+		}
+
+		expect := fmt.Sprintf(scriptHeader, "tracked") + "\n-- 2_b.sql\n" +
+			test.Expect
+		if b.String() != expect {
+			t.Errorf("%d)\nExpect:\n%s\nResult:\n%s", i, expect, b.String())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package migrator
+
+import (
+	"path"
+	"sort"
+)
+
+// State is the state of a migration.
+type State string
+
+// The states a migration can be in.
+const (
+	// StateApplied migrations have been run.
+	StateApplied State = "applied"
+	// StatePending migrations have not been run.
+	StatePending State = "pending"
+	// StateGap migrations have not been run but are older than ones that have.
+	StateGap State = "gap"
+	// StateOrphan migrations have been run but have no migration file.
+	StateOrphan State = "orphan"
+)
+
+// Status is the state of a single migration.
+type Status struct {
+	Version string
+	// Name is the name of the migration file, empty for orphans.
+	Name  string
+	State State
+}
+
+// Status lists every migration file and every migration that has been run,
+// in version order.
+func (m *Migrator) Status() ([]Status, error) {
+	files, done, err := m.load(false)
+	if err != nil {
+		return nil, err
+	}
+	return getStatuses(files, done), nil
+}
+
+// getStatuses compares the migration files against the tracked migrations.
+// A file that has not been run but is older than the newest run migration is
+// a gap, a tracked migration that has no file is an orphan.
+func getStatuses(files []string, done []TrackedMigration) []Status {
+	applied := make(map[string]bool, len(done))
+	var newest string
+	for _, d := range done {
+		applied[d.Migration] = true
+		if d.Migration > newest {
+			newest = d.Migration
+		}
+	}
+
+	statuses := make([]Status, 0, len(files))
+	haveFile := make(map[string]bool, len(files))
+	for _, f := range files {
+		version := migFormat(f)
+		haveFile[version] = true
+
+		s := Status{
+			Version: version,
+			Name:    path.Base(f),
+			State:   StatePending,
+		}
+		if applied[version] {
+			s.State = StateApplied
+		} else if version < newest {
+			s.State = StateGap
+		}
+		statuses = append(statuses, s)
+	}
+
+	for _, d := range done {
+		if !haveFile[d.Migration] {
+			statuses = append(statuses, Status{
+				Version: d.Migration,
+				State:   StateOrphan,
+			})
+		}
+	}
+
+	sort.Sort(statusesByVersion(statuses))
+	return statuses
+}
+
+type statusesByVersion []Status
+
+func (s statusesByVersion) Len() int           { return len(s) }
+func (s statusesByVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
+func (s statusesByVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,33 @@
+package migrator
+
+import (
+	. "testing"
+)
+
+func Test_GetStatuses(t *T) {
+	files := []string{
+		"db/migrate/1_a.sql",
+		"db/migrate/2_b.sql",
+		"db/migrate/3_c.sql",
+		"db/migrate/5_e.sql",
+	}
+	done := []TrackedMigration{{Migration: "1"}, {Migration: "3"}, {Migration: "4"}}
+
+	expect := []Status{
+		{"1", "1_a.sql", StateApplied},
+		{"2", "2_b.sql", StateGap},
+		{"3", "3_c.sql", StateApplied},
+		{"4", "", StateOrphan},
+		{"5", "5_e.sql", StatePending},
+	}
+
+	statuses := getStatuses(files, done)
+	if len(statuses) != len(expect) {
+		t.Fatalf("Expect: %#v\nResult: %#v", expect, statuses)
+	}
+	for i := range expect {
+		if statuses[i] != expect[i] {
+			t.Errorf("Expect: %#v\nResult: %#v", expect[i], statuses[i])
+		}
+	}
+}
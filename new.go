@@ -10,12 +10,12 @@ import (
 	"time"
 
 	"github.com/aarondl/dbm/config"
+	"github.com/aarondl/dbm/migrator"
 	"github.com/aarondl/paths"
 )
 
 const (
-	_MIG_DIR       = "migrate"
-	_MIG_SEPERATOR = "!========================!"
+	_MIG_DIR = "migrate"
 )
 
 // Constants for creation of migrations.
@@ -25,8 +25,8 @@ const (
 )
 
 // migLayout defines the layout for an SQL file
-const migLayout = "// Up migration code goes here\n" +
-	_MIG_SEPERATOR + "\n// Down migration code goes here"
+const migLayout = "-- Up migration code goes here\n" +
+	migrator.Separator + "\n-- Down migration code goes here\n"
 
 var (
 	rgxMigrate        = regexp.MustCompile(`^([a-z]|[a-z][a-z_]*[a-z])$`)
@@ -46,7 +46,8 @@ func newMigration(args []string) {
 
 	migName = time.Now().Format(timeLayout) + migName + ".sql"
 
-	dir := filepath.Join(workingDir, _DATA_DIR, _MIG_DIR)
+	mod := getModule("create a migration")
+	dir := migrationsDir(mod.conf)
 	file := filepath.Join(dir, migName)
 
 	if _, err := paths.EnsureDirectory(dir); err != nil {
@@ -62,5 +63,9 @@ func newMigration(args []string) {
 		exitLn("Error writing to file:", err)
 	}
 
-	fmt.Println("Create:", migName)
+	fmt.Fprintln(textOut(), "Create:", migName)
+	if jsonOutput() {
+		writeJSON(fileEvent{Event: "file", Module: mod.name, Path: file})
+		writeSummary(nil)
+	}
 }
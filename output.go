@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aarondl/dbm/migrator"
+)
+
+// Output formats for -format.
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// With -format=json each command writes one JSON object per line to stdout
+// and ends with a summary, anything meant for people goes to stderr.
+
+// migrationEvent is written after each migration is run or rolled back.
+type migrationEvent struct {
+	Event      string   `json:"event"`
+	Module     string   `json:"module,omitempty"`
+	Migration  string   `json:"migration"`
+	Direction  string   `json:"direction"`
+	Statements []string `json:"statements"`
+	DurationMS int64    `json:"duration_ms"`
+	Error      string   `json:"error,omitempty"`
+	// Statement is the statement that failed.
+	Statement string `json:"statement,omitempty"`
+}
+
+// statusEvent is written by status for each migration.
+type statusEvent struct {
+	Event   string `json:"event"`
+	Module  string `json:"module,omitempty"`
+	Version string `json:"version"`
+	Name    string `json:"name,omitempty"`
+	State   string `json:"state"`
+}
+
+// fileEvent is written by new and sql for the file they wrote.
+type fileEvent struct {
+	Event  string `json:"event"`
+	Module string `json:"module,omitempty"`
+	Path   string `json:"path"`
+}
+
+// summaryEvent is the last thing written by every command.
+type summaryEvent struct {
+	Event      string         `json:"event"`
+	Command    string         `json:"command"`
+	OK         bool           `json:"ok"`
+	Counts     map[string]int `json:"counts,omitempty"`
+	DurationMS int64          `json:"duration_ms"`
+	Error      string         `json:"error,omitempty"`
+}
+
+func jsonOutput() bool {
+	return *format == formatJSON
+}
+
+// textOut is where output meant for people goes.
+func textOut() io.Writer {
+	if jsonOutput() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// writeJSON writes v on its own line.
+func writeJSON(v interface{}) {
+	if err := json.NewEncoder(os.Stdout).Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing json:", err)
+		os.Exit(1)
+	}
+}
+
+func writeMigration(module string, e migrator.Event) {
+	direction := "up"
+	if e.Rollback {
+		direction = "down"
+	}
+
+	ev := migrationEvent{
+		Event:      "migration",
+		Module:     module,
+		Migration:  e.Migration,
+		Direction:  direction,
+		Statements: e.Statements,
+		DurationMS: e.Duration.Milliseconds(),
+	}
+	if ev.Statements == nil {
+		ev.Statements = []string{}
+	}
+
+	var stmtErr *migrator.StatementError
+	if errors.As(e.Err, &stmtErr) {
+		ev.Error = stmtErr.Err.Error()
+		ev.Statement = stmtErr.Stmt
+	} else if e.Err != nil {
+		ev.Error = e.Err.Error()
+	}
+	writeJSON(ev)
+}
+
+// writeSummary ends the output of a command that succeeded.
+func writeSummary(counts map[string]int) {
+	writeJSON(summaryEvent{
+		Event:      "summary",
+		Command:    command,
+		OK:         true,
+		Counts:     counts,
+		DurationMS: time.Since(started).Milliseconds(),
+	})
+}
+
+// exitJSON ends the output of a command that failed.
+func exitJSON(msg string) {
+	writeJSON(summaryEvent{
+		Event:      "summary",
+		Command:    command,
+		Error:      strings.TrimSpace(msg),
+		DurationMS: time.Since(started).Milliseconds(),
+	})
+	os.Exit(1)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aarondl/dbm/migrator"
+)
+
+// writeScript writes the migrations that would be run by migrate (or
+// rollback) to a file instead of running them, so it can be applied by hand.
+func writeScript(args []string) {
+	fs := flag.NewFlagSet("sql", flag.ExitOnError)
+	down := fs.Bool("down", false, "Write the rollback instead of the migration.")
+	out := fs.String("o", "dbm.sql", "The file to write the script to.")
+	since := fs.String("since", "",
+		"The newest version that has been run, instead of asking the database.")
+	step, to := getTarget(fs, args)
+
+	mod := getModule("write a script")
+	m := openMigrator(mod, len(*since) == 0)
+	if len(*since) == 0 {
+		defer m.Close()
+	}
+	// The statements go to the script, not the terminal.
+	m.DryRun = false
+	m.Verbose = false
+
+	f, err := os.Create(*out)
+	if err != nil {
+		exitLn("Could not create script file:", err)
+	}
+	defer f.Close()
+
+	n, err := m.Script(f, migrator.ScriptOptions{
+		Down:  *down,
+		Step:  step,
+		To:    to,
+		Since: *since,
+	})
+	if err != nil {
+		exitLn("Error writing script:", err)
+	}
+	if n == 0 && !jsonOutput() {
+		exitLn("Nothing to write.")
+	}
+
+	fmt.Fprintln(textOut(), "Wrote", n, "migrations to", *out)
+	if jsonOutput() {
+		writeJSON(fileEvent{Event: "file", Module: mod.name, Path: *out})
+		writeSummary(map[string]int{"migrations": n})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aarondl/dbm/migrator"
+)
+
+func showStatus(args []string) {
+	totals := make(map[string]int)
+	for i, mod := range getModules() {
+		if i > 0 && !jsonOutput() {
+			fmt.Println()
+		}
+		mod.header()
+		for state, n := range showModuleStatus(mod) {
+			totals[state] += n
+		}
+	}
+
+	if jsonOutput() {
+		writeSummary(totals)
+	}
+}
+
+// showModuleStatus prints the state of each migration in mod and returns
+// how many are in each state.
+func showModuleStatus(mod module) map[string]int {
+	m := openMigrator(mod, true)
+	defer m.Close()
+
+	statuses, err := m.Status()
+	if err != nil {
+		exitLn("Error getting migration data:", err)
+	}
+
+	counts := map[string]int{
+		string(migrator.StateApplied): 0,
+		string(migrator.StatePending): 0,
+		string(migrator.StateGap):     0,
+		string(migrator.StateOrphan):  0,
+	}
+	if len(statuses) == 0 && !jsonOutput() {
+		if len(mod.name) == 0 {
+			exitLn("No migrations.")
+		}
+		fmt.Println("No migrations.")
+		return counts
+	}
+
+	for _, s := range statuses {
+		counts[string(s.State)]++
+
+		if jsonOutput() {
+			writeJSON(statusEvent{
+				Event:   "status",
+				Module:  mod.name,
+				Version: s.Version,
+				Name:    s.Name,
+				State:   string(s.State),
+			})
+			continue
+		}
+
+		name := s.Name
+		if len(name) == 0 {
+			name = s.Version
+		}
+		fmt.Printf("[%s]\t%s\n", strings.ToUpper(string(s.State)), name)
+	}
+
+	if !jsonOutput() {
+		fmt.Printf("\n%d applied, %d pending, %d gaps, %d orphans\n",
+			counts[string(migrator.StateApplied)],
+			counts[string(migrator.StatePending)],
+			counts[string(migrator.StateGap)],
+			counts[string(migrator.StateOrphan)])
+	}
+	return counts
+}